@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lukaspj/StorageContainerProxy/pkg/proxy"
+	"github.com/spf13/cobra"
+)
+
+func newCheckCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Validate the configuration and that blob storage is reachable",
+		Long: `Builds the proxy from the same flags and config file as serving would,
+then checks that the storage container answers and that the default env has
+an index document. Exits non-zero if any check fails.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := buildConfig()
+			if err != nil {
+				fatalErr(err)
+			}
+
+			h, err := proxy.NewHandler(config)
+			if err != nil {
+				fatalErr(err)
+			}
+			results, err := h.Check()
+			if err != nil {
+				fatalErr(err)
+			}
+
+			failed := false
+			for _, r := range results {
+				if r.OK() {
+					fmt.Printf("ok    %-12s %s (%d)\n", r.Name, r.URL, r.Status)
+					continue
+				}
+				failed = true
+				fmt.Printf("FAIL  %-12s %s: %v\n", r.Name, r.URL, r.Err)
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/lukaspj/StorageContainerProxy/pkg/proxy"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -18,41 +26,403 @@ var (
 	baseDomain       string
 	defaultEnv       string
 	useSubdomains    bool
+	port             int
+	shutdownGrace    time.Duration
+	insecureTLS      bool
+	maxIdleConns     int
+	maxIdlePerHost   int
+	idleConnTimeout  time.Duration
+	cacheTTL         time.Duration
+	cacheMaxBytes    int64
+	cacheMaxEntries  int
+	cacheBackend     string
+	cacheRedisURL    string
+	cacheRedisTTL    time.Duration
+	cacheDir         string
+	cacheErrBackoff  time.Duration
+	staleRevalidate  bool
+	cacheableCodes   []int
+	cacheableMethods []string
+	allowedMethods   []string
+	notFoundPage     string
+	fallbackEnvs     []string
+	maxFallbacks     int
+	spaMode          bool
+	redirectSlash    bool
+	slashPolicy      string
+	canonicalIndex   bool
+	dirListing       bool
+	dirListingLimit  int
+	noFallbackPaths  []string
+	metrics          bool
+	tracing          bool
+	otlpEndpoint     string
+	logLevel         string
+	logFormat        string
+	redirectExts     []string
+	redirectMode     string
+	forceDownloads   []string
+	hostMismatch     string
+	hostRedirectTo   string
+	corsOrigins      []string
+	corsMethods      []string
+	corsHeaders      []string
+	corsExposed      []string
+	corsCredentials  bool
+	compressLevel    int
+	compressTypes    []string
+	sasToken         string
+	authMode         string
+	managedIdentity  string
+	endpointSuffix   string
+	blobEndpoint     string
+	upstreamPrefix   string
+	upstreamTimeout  time.Duration
+	stripHeaders     []string
+	securityHeaders  proxy.SecurityHeadersOptions
+	forceHtmlType    bool
+	contentTypes     map[string]string
+	cacheControl     string
+	htmlCacheControl string
+	maxBufferBytes   int64
+	containerRoutes  map[string]string
+	debug            bool
+	httpsRedirect    bool
+	tlsCertFile      string
+	tlsKeyFile       string
+	autoTLS          bool
+	autoTLSCacheDir  string
+	httpPort         int
+	listenAddr       string
+	unixSocket       string
+	h2cEnabled       bool
+	trustedProxies   []string
+	negativeTTL      time.Duration
+	negativeEntries  int
+	accessLog        string
+	statsEndpoint    bool
+	indexDocument    string
+	precompressed    bool
+	basicAuth        proxy.BasicAuthOptions
+	robotsTxt        string
+	favicon          proxy.FaviconOptions
+	allowCIDRs       []string
+	denyCIDRs        []string
+	rateLimitRPS     float64
+	rateLimitBurst   int
+	maxRetries       int
+	retryBackoff     time.Duration
+	localDir         string
+	adminToken       string
 )
 
-func GetRootCmd() *cobra.Command {
-	cobra.OnInitialize(initConfig)
+func GetRootCmd() (*cobra.Command, error) {
+	var rootCmd *cobra.Command
+	cobra.OnInitialize(func() {
+		initConfig(rootCmd.PersistentFlags())
+	})
 
-	rootCmd := &cobra.Command{
+	rootCmd = &cobra.Command{
 		Use:   "scproxy",
 		Short: "StorageContainerProxy is a tool for...",
-		Run: func(cmd *cobra.Command, args []string) {
-			h := proxy.NewHandler(&proxy.Config{
-				AzureStorageAccount:   storageAccount,
-				AzureStorageContainer: storageContainer,
-				BaseDomain:            baseDomain,
-				DefaultEnv:            defaultEnv,
-				UseSubdomains:         useSubdomains,
-			})
-			h.Listen()
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Errors past this point are about the configuration or the
+			// listener, not the command line, so don't print the usage.
+			cmd.SilenceUsage = true
+
+			config, err := buildConfig()
+			if err != nil {
+				return err
+			}
+
+			h, err := proxy.NewHandler(config)
+			if err != nil {
+				return err
+			}
+			config.Logger.Info("effective configuration", "config", config.Redacted())
+			if tracing {
+				shutdown, err := setupTracing(otlpEndpoint)
+				if err != nil {
+					return err
+				}
+				// Returning the error to cobra instead of exiting here lets
+				// this flush the spans that haven't been exported yet.
+				defer shutdown()
+			}
+			return h.ListenWithContext(signalContext(cmd.Context()))
 		},
 	}
 
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cobra.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.scproxy.yaml)")
 	rootCmd.PersistentFlags().StringVar(&storageAccount, "azStorageAccount", "", "")
 	rootCmd.PersistentFlags().StringVar(&storageContainer, "azStorageContainer", "", "")
 	rootCmd.PersistentFlags().StringVar(&baseDomain, "baseDomain", "", "")
 	rootCmd.PersistentFlags().StringVar(&defaultEnv, "defaultEnv", "master", "")
-	rootCmd.PersistentFlags().BoolVar(&useSubdomains, "useSubdomains", true, "")
+	rootCmd.PersistentFlags().BoolVar(&useSubdomains, "useSubdomains", true, "serve envs as subdomains of --baseDomain (default false for --localDir without --baseDomain)")
+	rootCmd.PersistentFlags().IntVar(&port, "port", 3000, "")
+	rootCmd.PersistentFlags().StringVar(&listenAddr, "listenAddr", "", "host or IP address to listen on, e.g. 127.0.0.1 (default all interfaces)")
+	rootCmd.PersistentFlags().StringVar(&unixSocket, "unixSocket", "", "serve on a Unix domain socket at this path instead of --port")
+	rootCmd.PersistentFlags().BoolVar(&h2cEnabled, "h2c", false, "serve HTTP/2 without TLS to clients that ask for it")
+	rootCmd.PersistentFlags().DurationVar(&shutdownGrace, "shutdownGracePeriod", 30*time.Second, "")
+	rootCmd.PersistentFlags().BoolVar(&insecureTLS, "insecureSkipTLSVerify", false, "")
+	rootCmd.PersistentFlags().IntVar(&maxIdleConns, "maxIdleConns", 100, "")
+	rootCmd.PersistentFlags().IntVar(&maxIdlePerHost, "maxIdleConnsPerHost", 100, "")
+	rootCmd.PersistentFlags().DurationVar(&idleConnTimeout, "idleConnTimeout", 90*time.Second, "")
+	rootCmd.PersistentFlags().DurationVar(&cacheTTL, "cacheTTL", 10*time.Second, "")
+	rootCmd.PersistentFlags().Int64Var(&cacheMaxBytes, "cacheMaxBytes", 256<<20, "")
+	rootCmd.PersistentFlags().IntVar(&cacheMaxEntries, "cacheMaxEntries", 0, "")
+	rootCmd.PersistentFlags().StringVar(&cacheBackend, "cacheBackend", "memory", "memory, redis to share the cache between replicas, disk, or none")
+	rootCmd.PersistentFlags().StringVar(&cacheRedisURL, "cacheRedisUrl", "", "Redis URL for the redis cache backend, e.g. redis://:password@host:6379/0")
+	rootCmd.PersistentFlags().DurationVar(&cacheRedisTTL, "cacheRedisTTL", 24*time.Hour, "how long Redis keeps an entry after it was last revalidated")
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cacheDir", "", "directory for the disk cache backend, limited by cacheMaxBytes and cacheMaxEntries")
+	rootCmd.PersistentFlags().BoolVar(&staleRevalidate, "staleWhileRevalidate", false, "serve expired entries immediately and revalidate them in the background")
+	rootCmd.PersistentFlags().DurationVar(&cacheErrBackoff, "cacheErrorBackoff", 5*time.Second, "how long to keep serving a stale entry before retrying a failed revalidation")
+	rootCmd.PersistentFlags().IntSliceVar(&cacheableCodes, "cacheableStatusCodes", []int{http.StatusOK}, "")
+	rootCmd.PersistentFlags().StringSliceVar(&cacheableMethods, "cacheableMethods", []string{http.MethodGet}, "e.g. GET,HEAD, empty disables the cache")
+	rootCmd.PersistentFlags().StringVar(&notFoundPage, "notFoundPage", "", "")
+	rootCmd.PersistentFlags().StringVar(&indexDocument, "indexDocument", "index.html", "")
+	rootCmd.PersistentFlags().StringSliceVar(&fallbackEnvs, "fallbackEnvs", nil, "")
+	rootCmd.PersistentFlags().IntVar(&maxFallbacks, "maxFallbacks", 0, "fallback paths tried per request before serving the 404, 0 tries them all")
+	rootCmd.PersistentFlags().BoolVar(&redirectSlash, "redirectTrailingSlash", false, "redirect paths that resolve to dir/index.html to the path with a trailing slash, so relative links work")
+	rootCmd.PersistentFlags().StringVar(&slashPolicy, "trailingSlashPolicy", "none", "redirect extensionless paths to a canonical form: none, add a trailing slash, or remove it")
+	rootCmd.PersistentFlags().BoolVar(&canonicalIndex, "canonicalizeIndex", false, "redirect requests for dir/index.html to dir/")
+	rootCmd.PersistentFlags().BoolVar(&dirListing, "directoryListing", false, "list the blobs under directory paths without an index document, needs list permission")
+	rootCmd.PersistentFlags().IntVar(&dirListingLimit, "directoryListingLimit", 10000, "most entries shown in a directory listing")
+	rootCmd.PersistentFlags().BoolVar(&spaMode, "spa", false, "serve the env's index document for unknown extensionless paths, for single-page apps")
+	rootCmd.PersistentFlags().StringSliceVar(&noFallbackPaths, "noFallbackPaths", nil, "globs for paths proxied without fallbacks, e.g. /config.json")
+	rootCmd.PersistentFlags().BoolVar(&metrics, "metrics", false, "")
+	rootCmd.PersistentFlags().BoolVar(&tracing, "otel", false, "export OpenTelemetry traces over OTLP/HTTP")
+	rootCmd.PersistentFlags().StringVar(&otlpEndpoint, "otlpEndpoint", "", "OTLP/HTTP endpoint URL for traces (default OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318)")
+	rootCmd.PersistentFlags().BoolVar(&statsEndpoint, "stats", false, "serve request and cache counters as JSON at /_scproxy/stats")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "logLevel", "info", "debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "logFormat", "text", "text or json")
+	rootCmd.PersistentFlags().StringVar(&accessLog, "accessLog", "", "access log format written to stdout, clf or json (default off)")
+	rootCmd.PersistentFlags().StringSliceVar(&redirectExts, "redirectExtensions", []string{".jpg", ".png", ".jpeg", ".zip", ".js"}, "")
+	rootCmd.PersistentFlags().StringVar(&redirectMode, "redirectMode", "redirect", "redirect or proxy")
+	rootCmd.PersistentFlags().StringSliceVar(&forceDownloads, "forceDownloadExtensions", nil, "extensions served as downloads with Content-Disposition: attachment, proxied even if redirected")
+	rootCmd.PersistentFlags().StringVar(&hostMismatch, "hostMismatchAction", "error", "what to do with hosts outside the base domain: error, redirect or defaultEnv")
+	rootCmd.PersistentFlags().StringVar(&hostRedirectTo, "hostRedirectTo", "", "canonical URL mismatched hosts are redirected to with --hostMismatchAction redirect")
+	rootCmd.PersistentFlags().StringSliceVar(&corsOrigins, "corsAllowedOrigins", nil, "")
+	rootCmd.PersistentFlags().StringSliceVar(&allowedMethods, "allowedMethods", []string{http.MethodGet, http.MethodHead, http.MethodOptions}, "request methods proxied, others get a 405, empty allows any")
+	rootCmd.PersistentFlags().StringSliceVar(&corsMethods, "corsAllowedMethods", nil, "")
+	rootCmd.PersistentFlags().StringSliceVar(&corsHeaders, "corsAllowedHeaders", nil, "request headers allowed in CORS requests, * allows any (default Origin, Accept, Content-Type)")
+	rootCmd.PersistentFlags().StringSliceVar(&corsExposed, "corsExposedHeaders", nil, "response headers exposed to scripts, e.g. ETag,Content-Md5")
+	rootCmd.PersistentFlags().BoolVar(&corsCredentials, "corsAllowCredentials", false, "")
+	rootCmd.PersistentFlags().IntVar(&compressLevel, "compressionLevel", 5, "gzip level 0-9, negative disables compression")
+	rootCmd.PersistentFlags().StringSliceVar(&compressTypes, "compressibleTypes", nil, "")
+	rootCmd.PersistentFlags().BoolVar(&precompressed, "servePrecompressed", false, "serve .br and .gz siblings of files to clients that accept them")
+	rootCmd.PersistentFlags().StringVar(&sasToken, "sasToken", "", "prefer SCPROXY_SASTOKEN or the config file to keep it out of process listings")
+	rootCmd.PersistentFlags().StringVar(&authMode, "authMode", "", "none, sas or managedIdentity (default sas when --sasToken is set, otherwise none)")
+	rootCmd.PersistentFlags().StringVar(&managedIdentity, "managedIdentityClientId", "", "client ID of a user-assigned managed identity")
+	rootCmd.PersistentFlags().StringVar(&endpointSuffix, "endpointSuffix", "blob.core.windows.net", "")
+	rootCmd.PersistentFlags().StringVar(&blobEndpoint, "blobEndpoint", "", "full account URL, overrides --azStorageAccount and --endpointSuffix; the container URL when --azStorageContainer is unset")
+	rootCmd.PersistentFlags().StringVar(&upstreamPrefix, "upstreamPathPrefix", "", "folder in the container that paths are served from, e.g. dist")
+	rootCmd.PersistentFlags().DurationVar(&upstreamTimeout, "upstreamTimeout", 30*time.Second, "")
+	rootCmd.PersistentFlags().IntVar(&maxRetries, "maxRetries", 0, "retries for GET and HEAD requests failing with a connection error or 5xx, at most 5")
+	rootCmd.PersistentFlags().DurationVar(&retryBackoff, "retryBackoff", 100*time.Millisecond, "")
+	rootCmd.PersistentFlags().StringVar(&adminToken, "adminToken", "", "bearer token enabling POST /_scproxy/purge and /_scproxy/invalidate, prefer SCPROXY_ADMINTOKEN or the config file")
+	rootCmd.PersistentFlags().StringVar(&localDir, "localDir", "", "serve files from this directory instead of blob storage, for offline development")
+	rootCmd.PersistentFlags().StringSliceVar(&stripHeaders, "stripHeaderPrefixes", []string{"x-ms-"}, "")
+	rootCmd.PersistentFlags().StringVar(&securityHeaders.StrictTransportSecurity, "hsts", "", "e.g. max-age=31536000; includeSubDomains")
+	rootCmd.PersistentFlags().StringVar(&securityHeaders.ContentTypeOptions, "contentTypeOptions", "", "e.g. nosniff")
+	rootCmd.PersistentFlags().StringVar(&securityHeaders.FrameOptions, "frameOptions", "", "e.g. DENY or SAMEORIGIN")
+	rootCmd.PersistentFlags().StringVar(&securityHeaders.ContentSecurityPolicy, "contentSecurityPolicy", "", "")
+	rootCmd.PersistentFlags().StringVar(&basicAuth.Username, "basicAuthUsername", "", "require HTTP basic auth with this username")
+	rootCmd.PersistentFlags().StringVar(&basicAuth.Password, "basicAuthPassword", "", "prefer SCPROXY_BASICAUTHPASSWORD or the config file to keep it out of process listings")
+	rootCmd.PersistentFlags().StringVar(&basicAuth.PasswordHash, "basicAuthPasswordHash", "", "bcrypt hash of the basic auth password")
+	rootCmd.PersistentFlags().StringSliceVar(&basicAuth.Paths, "basicAuthPaths", nil, "path prefixes to protect (default all)")
+	rootCmd.PersistentFlags().StringVar(&robotsTxt, "robotsTxt", "", "body served at /robots.txt without asking blob storage")
+	rootCmd.PersistentFlags().StringVar(&favicon.File, "faviconFile", "", "file served at /favicon.ico")
+	rootCmd.PersistentFlags().StringVar(&favicon.RedirectTo, "faviconRedirect", "", "path or URL /favicon.ico redirects to")
+	rootCmd.PersistentFlags().BoolVar(&favicon.NoContent, "faviconNoContent", false, "answer /favicon.ico with 204 No Content")
+	rootCmd.PersistentFlags().BoolVar(&forceHtmlType, "forceHtmlContentType", false, "")
+	rootCmd.PersistentFlags().StringVar(&cacheControl, "defaultCacheControl", "", "Cache-Control for responses without one, e.g. public, max-age=3600")
+	rootCmd.PersistentFlags().StringVar(&htmlCacheControl, "defaultHtmlCacheControl", "", "Cache-Control for HTML pages without one (default --defaultCacheControl)")
+	rootCmd.PersistentFlags().StringToStringVar(&contentTypes, "contentTypeOverrides", nil, "content type by file extension, e.g. .wasm=application/wasm")
+	rootCmd.PersistentFlags().Int64Var(&maxBufferBytes, "maxBufferBytes", 8<<20, "")
+	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "serve /_scproxy/explain to show how a URL is resolved, and the redacted config at /_scproxy/config")
+	rootCmd.PersistentFlags().BoolVar(&httpsRedirect, "httpsRedirect", false, "")
+	rootCmd.PersistentFlags().StringVar(&tlsCertFile, "tlsCert", "", "serve HTTPS on --port with this certificate")
+	rootCmd.PersistentFlags().StringVar(&tlsKeyFile, "tlsKey", "", "")
+	rootCmd.PersistentFlags().BoolVar(&autoTLS, "autoTLS", false, "serve HTTPS on --port with certificates from Let's Encrypt for --baseDomain and its subdomains")
+	rootCmd.PersistentFlags().StringVar(&autoTLSCacheDir, "autoTLSCacheDir", "autocert", "")
+	rootCmd.PersistentFlags().IntVar(&httpPort, "httpPort", 0, "also serve plain HTTP on this port when serving HTTPS, e.g. 80 with --httpsRedirect")
+	rootCmd.PersistentFlags().StringSliceVar(&allowCIDRs, "allowCIDRs", nil, "only serve clients in these CIDRs or IPs")
+	rootCmd.PersistentFlags().StringSliceVar(&denyCIDRs, "denyCIDRs", nil, "refuse clients in these CIDRs or IPs")
+	rootCmd.PersistentFlags().Float64Var(&rateLimitRPS, "rateLimitRPS", 0, "requests per second allowed per client IP, 0 disables")
+	rootCmd.PersistentFlags().IntVar(&rateLimitBurst, "rateLimitBurst", 0, "burst size per client IP, 0 uses rateLimitRPS rounded up")
+	rootCmd.PersistentFlags().StringSliceVar(&trustedProxies, "trustedProxies", nil, "CIDRs or IPs whose X-Forwarded-* headers are trusted")
+	rootCmd.PersistentFlags().DurationVar(&negativeTTL, "negativeCacheTTL", 0, "how long to remember paths that 404 after every fallback, 0 disables")
+	rootCmd.PersistentFlags().IntVar(&negativeEntries, "negativeCacheMaxEntries", 10000, "")
+	rootCmd.PersistentFlags().StringToStringVar(&containerRoutes, "containerRoutes", nil, "path prefix to container, e.g. app1=containera,app2=containerb")
+
+	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
+		return nil, err
+	}
+	rootCmd.AddCommand(newWarmCmd())
+	rootCmd.AddCommand(newCheckCmd())
 
-	rootCmd.MarkPersistentFlagRequired("azStorageAccount")
-	rootCmd.MarkPersistentFlagRequired("azStorageContainer")
-	rootCmd.MarkPersistentFlagRequired("baseDomain")
+	return rootCmd, nil
+}
+
+// buildConfig turns the flags, config file and environment into a proxy
+// configuration.
+func buildConfig() (*proxy.Config, error) {
+	logger, err := proxy.NewLogger(os.Stderr, logLevel, logFormat)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := proxy.ParseRedirectMode(redirectMode)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := proxy.ParseCacheBackend(cacheBackend)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := proxy.ParseTrailingSlashPolicy(slashPolicy)
+	if err != nil {
+		return nil, err
+	}
+	mismatch, err := proxy.ParseHostMismatchAction(hostMismatch)
+	if err != nil {
+		return nil, err
+	}
+	var redirectTo *url.URL
+	if hostRedirectTo != "" {
+		redirectTo, err = url.Parse(hostRedirectTo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var endpoint *url.URL
+	if blobEndpoint != "" {
+		endpoint, err = url.Parse(blobEndpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var auth proxy.AuthMode
+	if authMode != "" {
+		auth, err = proxy.ParseAuthMode(authMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A local directory needs no base domain to be useful, so serving one
+	// without --baseDomain drops subdomains unless they were asked for.
+	subdomains := useSubdomains
+	if localDir != "" && baseDomain == "" && !viper.IsSet("useSubdomains") {
+		subdomains = false
+	}
 
-	return rootCmd
+	config := &proxy.Config{
+		AzureStorageAccount:   storageAccount,
+		AzureStorageContainer: storageContainer,
+		BaseDomain:            baseDomain,
+		DefaultEnv:            defaultEnv,
+		UseSubdomains:         subdomains,
+		Port:                  port,
+		ShutdownGracePeriod:   shutdownGrace,
+		InsecureSkipVerify:    insecureTLS,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		CacheTTL:              cacheTTL,
+		CacheMaxBytes:         cacheMaxBytes,
+		CacheMaxEntries:       cacheMaxEntries,
+		CacheBackend:          backend,
+		CacheRedisURL:         cacheRedisURL,
+		CacheRedisTTL:         cacheRedisTTL,
+		CacheDir:              cacheDir,
+		CacheErrorBackoff:     cacheErrBackoff,
+		StaleWhileRevalidate:  staleRevalidate,
+		CacheableStatusCodes:  cacheableCodes,
+		CacheableMethods:      cacheableMethods,
+		AllowedMethods:        allowedMethods,
+		NotFoundPage:          notFoundPage,
+		FallbackEnvs:          fallbackEnvs,
+		MaxFallbacks:          maxFallbacks,
+		SPAMode:               spaMode,
+		RedirectTrailingSlash: redirectSlash,
+		TrailingSlashPolicy:   policy,
+		CanonicalizeIndex:     canonicalIndex,
+		DirectoryListing:      dirListing,
+		DirectoryListingLimit: dirListingLimit,
+		NoFallbackPaths:       noFallbackPaths,
+		Metrics:               metrics,
+		Tracing:               tracing,
+		Logger:                logger,
+		RedirectExtensions:    redirectExts,
+		ForceDownloads:        forceDownloads,
+		RedirectMode:          mode,
+		HostMismatchAction:    mismatch,
+		HostRedirectTo:        redirectTo,
+		CORSAllowedOrigins:    corsOrigins,
+		CORSAllowedMethods:    corsMethods,
+		CORSAllowedHeaders:    corsHeaders,
+		CORSExposedHeaders:    corsExposed,
+		CORSAllowCredentials:  corsCredentials,
+		CompressionLevel:      compressLevel,
+		CompressibleTypes:     compressTypes,
+		SASToken:              sasToken,
+		AuthMode:              auth,
+		ManagedIdentityID:     managedIdentity,
+		EndpointSuffix:        endpointSuffix,
+		BlobEndpoint:          endpoint,
+		UpstreamPathPrefix:    upstreamPrefix,
+		UpstreamTimeout:       upstreamTimeout,
+		StripHeaderPrefixes:   stripHeaders,
+		SecurityHeaders:       securityHeaders,
+		ForceHtmlContentType:  forceHtmlType,
+		ContentTypeOverrides:  contentTypes,
+		DefaultCacheControl:   cacheControl,
+		HTMLCacheControl:      htmlCacheControl,
+		MaxBufferBytes:        maxBufferBytes,
+		ContainerRoutes:       containerRoutes,
+		Debug:                 debug,
+		HTTPSRedirect:         httpsRedirect,
+		TLSCertFile:           tlsCertFile,
+		TLSKeyFile:            tlsKeyFile,
+		AutoTLS:               autoTLS,
+		AutoTLSCacheDir:       autoTLSCacheDir,
+		HTTPPort:              httpPort,
+		ListenAddr:            listenAddr,
+		UnixSocket:            unixSocket,
+		H2C:                   h2cEnabled,
+		TrustedProxies:        trustedProxies,
+		NegativeCacheTTL:      negativeTTL,
+		NegativeCacheEntries:  negativeEntries,
+		AccessLog:             accessLog,
+		StatsEndpoint:         statsEndpoint,
+		IndexDocument:         indexDocument,
+		ServePrecompressed:    precompressed,
+		BasicAuth:             basicAuth,
+		RobotsTxt:             robotsTxt,
+		Favicon:               favicon,
+		AllowCIDRs:            allowCIDRs,
+		DenyCIDRs:             denyCIDRs,
+		RateLimitRPS:          rateLimitRPS,
+		RateLimitBurst:        rateLimitBurst,
+		MaxRetries:            maxRetries,
+		RetryBackoff:          retryBackoff,
+		AdminToken:            adminToken,
+		LocalDir:              localDir,
+	}
+	if err := viper.UnmarshalKey("headerRules", &config.HeaderRules); err != nil {
+		return nil, fmt.Errorf("invalid headerRules in config: %v", err)
+	}
+	if err := viper.UnmarshalKey("rewriteRules", &config.RewriteRules); err != nil {
+		return nil, fmt.Errorf("invalid rewriteRules in config: %v", err)
+	}
+	config.HostRoutes, err = hostRoutesFromConfig(*config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
-func initConfig() {
+func initConfig(flags *pflag.FlagSet) {
 	if cfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(cfgFile)
@@ -63,16 +433,122 @@ func initConfig() {
 			fatalErr(err)
 		}
 
-		// Search config in home directory with name ".cobra" (without extension).
+		// Search config in home directory with name ".scproxy" (without extension).
 		viper.AddConfigPath(home)
 		viper.SetConfigName(".scproxy")
 	}
 
+	viper.SetEnvPrefix("SCPROXY")
 	viper.AutomaticEnv()
 
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	applyConfigToFlags(flags)
+}
+
+// applyConfigToFlags copies values from the config file and environment onto
+// any flag that wasn't given on the command line, so the flag variables are
+// the single source of truth.
+func applyConfigToFlags(flags *pflag.FlagSet) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Name == "config" || !viper.IsSet(f.Name) {
+			return
+		}
+
+		value := viper.GetString(f.Name)
+		if strings.HasSuffix(f.Value.Type(), "Slice") {
+			value = strings.Join(viper.GetStringSlice(f.Name), ",")
+		}
+		if _, ok := viper.Get(f.Name).(map[string]interface{}); ok {
+			var pairs []string
+			for k, v := range viper.GetStringMapString(f.Name) {
+				pairs = append(pairs, k+"="+v)
+			}
+			value = strings.Join(pairs, ",")
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			fatalErr(fmt.Errorf("invalid value for %s in config: %v", f.Name, err))
+		}
+	})
+}
+
+// hostRoutesFromConfig reads the hostRoutes section of the config file. Each
+// host inherits every setting from base and may override the account,
+// container, credentials and subdomain handling, e.g.
+//
+//	hostRoutes:
+//	  tenanta.example.com:
+//	    azStorageAccount: tenanta
+//	    azStorageContainer: web
+//	    useSubdomains: false
+func hostRoutesFromConfig(base proxy.Config) (map[string]proxy.Config, error) {
+	if !viper.IsSet("hostRoutes") {
+		return nil, nil
+	}
+
+	routes := map[string]proxy.Config{}
+	for host, raw := range viper.GetStringMap("hostRoutes") {
+		sub := viper.New()
+		settings, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("hostRoutes.%s must be a map of settings", host)
+		}
+		if err := sub.MergeConfigMap(settings); err != nil {
+			return nil, err
+		}
+
+		config := base
+		config.HostRoutes = nil
+		config.ContainerRoutes = nil
+		if sub.IsSet("azStorageAccount") {
+			config.AzureStorageAccount = sub.GetString("azStorageAccount")
+		}
+		if sub.IsSet("azStorageContainer") {
+			config.AzureStorageContainer = sub.GetString("azStorageContainer")
+		}
+		if sub.IsSet("baseDomain") {
+			config.BaseDomain = sub.GetString("baseDomain")
+		}
+		if sub.IsSet("defaultEnv") {
+			config.DefaultEnv = sub.GetString("defaultEnv")
+		}
+		if sub.IsSet("useSubdomains") {
+			config.UseSubdomains = sub.GetBool("useSubdomains")
+		}
+		if sub.IsSet("sasToken") {
+			config.SASToken = sub.GetString("sasToken")
+		}
+		if sub.IsSet("blobEndpoint") {
+			endpoint, err := url.Parse(sub.GetString("blobEndpoint"))
+			if err != nil {
+				return nil, fmt.Errorf("hostRoutes.%s: %w", host, err)
+			}
+			config.BlobEndpoint = endpoint
+		}
+		if sub.IsSet("upstreamPathPrefix") {
+			config.UpstreamPathPrefix = sub.GetString("upstreamPathPrefix")
+		}
+		if sub.IsSet("containerRoutes") {
+			config.ContainerRoutes = sub.GetStringMapString("containerRoutes")
+		}
+		routes[host] = config
+	}
+	return routes, nil
+}
+
+// signalContext returns a context derived from parent that is cancelled on
+// SIGINT or SIGTERM.
+func signalContext(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+	return ctx
 }
 
 func fatalErr(msg interface{}) {
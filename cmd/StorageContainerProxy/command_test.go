@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lukaspj/StorageContainerProxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+const testConfigFile = `
+azStorageAccount: myaccount
+azStorageContainer: web
+baseDomain: example.com
+defaultEnv: main
+useSubdomains: false
+port: 8080
+cacheTTL: 5m
+corsAllowedOrigins:
+  - https://app.example.com
+  - https://admin.example.com
+contentTypeOverrides:
+  .wasm: application/wasm
+headerRules:
+  - glob: "*.js"
+    set:
+      Cache-Control: public, max-age=31536000, immutable
+hostRoutes:
+  other.example.com:
+    azStorageAccount: otheraccount
+    useSubdomains: true
+`
+
+func TestConfigFile(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	rootCmd, err := GetRootCmd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "scproxy.yaml")
+	if err := os.WriteFile(file, []byte(testConfigFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rootCmd.PersistentFlags().Set("config", file); err != nil {
+		t.Fatal(err)
+	}
+	// Secrets can come from the environment instead.
+	t.Setenv("SCPROXY_SASTOKEN", "sv=2020-08-04&sig=secret")
+	initConfig(rootCmd.PersistentFlags())
+
+	config, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"AzureStorageAccount", config.AzureStorageAccount, "myaccount"},
+		{"AzureStorageContainer", config.AzureStorageContainer, "web"},
+		{"BaseDomain", config.BaseDomain, "example.com"},
+		{"DefaultEnv", config.DefaultEnv, "main"},
+		{"UseSubdomains", config.UseSubdomains, false},
+		{"Port", config.Port, 8080},
+		{"CacheTTL", config.CacheTTL, 5 * time.Minute},
+		{"CORSAllowedOrigins", config.CORSAllowedOrigins, []string{"https://app.example.com", "https://admin.example.com"}},
+		{"ContentTypeOverrides", config.ContentTypeOverrides, map[string]string{".wasm": "application/wasm"}},
+		{"HeaderRules", config.HeaderRules, []proxy.HeaderRule{{Glob: "*.js", Set: map[string]string{"Cache-Control": "public, max-age=31536000, immutable"}}}},
+		{"SASToken", config.SASToken, "sv=2020-08-04&sig=secret"},
+		// Settings the config file doesn't mention keep their flag defaults.
+		{"MaxBufferBytes", config.MaxBufferBytes, int64(8 << 20)},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s = %#v, want %#v", tc.name, tc.got, tc.want)
+		}
+	}
+
+	route, ok := config.HostRoutes["other.example.com"]
+	if !ok {
+		t.Fatalf("HostRoutes = %v, want other.example.com", config.HostRoutes)
+	}
+	if route.AzureStorageAccount != "otheraccount" || route.AzureStorageContainer != "web" || !route.UseSubdomains {
+		t.Errorf("host route = account %q, container %q, useSubdomains %v, want otheraccount, web, true",
+			route.AzureStorageAccount, route.AzureStorageContainer, route.UseSubdomains)
+	}
+
+	h, err := proxy.NewHandler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Port != 8080 || h.Target.String() != "https://myaccount.blob.core.windows.net/web" || h.AuthMode != proxy.AuthModeSAS {
+		t.Errorf("handler = port %d, target %s, auth mode %s, want 8080, https://myaccount.blob.core.windows.net/web, sas",
+			h.Port, h.Target, h.AuthMode)
+	}
+}
+
+// executeCmd runs scproxy with args on a loopback port of its own. The
+// context is already cancelled, so serving returns as soon as the listener
+// is up.
+func executeCmd(t *testing.T, args ...string) error {
+	t.Helper()
+	t.Cleanup(viper.Reset)
+	// Keep a ~/.scproxy.yaml out of the test.
+	t.Setenv("HOME", t.TempDir())
+	rootCmd, err := GetRootCmd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCmd.SetArgs(append([]string{"--listenAddr", "127.0.0.1", "--port", "0"}, args...))
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetErr(io.Discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return rootCmd.ExecuteContext(ctx)
+}
+
+// A failure after tracing is set up is returned to cobra instead of exiting,
+// so the deferred flush of the tracer still runs.
+func TestRootCmdReturnsListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	err = executeCmd(t,
+		"--azStorageAccount", "myaccount", "--azStorageContainer", "web", "--baseDomain", "example.com",
+		"--otel", "--otlpEndpoint", "http://127.0.0.1:1",
+		"--port", port)
+	if err == nil {
+		t.Fatalf("scproxy on port %s in use = nil, want a listen error", port)
+	}
+}
+
+func TestRootCmdRequiredSettings(t *testing.T) {
+	site := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"local dir", []string{"--localDir", site, "--useSubdomains=false"}, ""},
+		{"only local dir", []string{"--localDir", site}, ""},
+		{"storage account", []string{"--azStorageAccount", "myaccount", "--azStorageContainer", "web", "--baseDomain", "example.com"}, ""},
+		{"blob endpoint", []string{"--blobEndpoint", "http://127.0.0.1:10000/devstoreaccount1", "--useSubdomains=false"}, ""},
+		{"nothing", nil, "missing required settings: a storage account or blob endpoint, a storage container, a base domain when using subdomains"},
+		{"no container", []string{"--azStorageAccount", "myaccount", "--useSubdomains=false"}, "missing required settings: a storage container"},
+		{"no base domain", []string{"--localDir", site, "--useSubdomains"}, "missing required settings: a base domain when using subdomains"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := executeCmd(t, tc.args...)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("scproxy %v = %v, want nil", tc.args, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("scproxy %v = %v, want %q", tc.args, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Warming a proxy that is already running neither needs nor builds the
+// storage settings; only --serve does.
+func TestWarmCmdWithoutStorageSettings(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+
+	paths := filepath.Join(t.TempDir(), "paths.txt")
+	if err := os.WriteFile(paths, []byte("/f\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// An invalid cache backend would fail any attempt to build the config.
+	if err := executeCmd(t, "warm", "--paths", paths, "--url", srv.URL, "--cacheBackend", "bogus"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("proxy requests = %d, want 1", got)
+	}
+
+	err := executeCmd(t, "warm", "--serve", "--paths", paths, "--url", srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "missing required settings") {
+		t.Errorf("warm --serve without storage settings = %v, want missing required settings", err)
+	}
+}
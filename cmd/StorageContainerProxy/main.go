@@ -2,11 +2,16 @@ package main
 
 import (
 	"log"
+	"os"
 )
 
 func main() {
-	err := GetRootCmd().Execute()
+	rootCmd, err := GetRootCmd()
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Execute already printed the error.
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
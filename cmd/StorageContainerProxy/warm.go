@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lukaspj/StorageContainerProxy/pkg/proxy"
+	"github.com/spf13/cobra"
+)
+
+type warmRequest struct {
+	host string
+	path string
+}
+
+func newWarmCmd() *cobra.Command {
+	var (
+		pathsFile   string
+		sitemapURL  string
+		proxyURL    string
+		host        string
+		concurrency int
+		serve       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "warm",
+		Short: "Populate the response cache by requesting a list of paths through the proxy",
+		Long: `Requests every path listed in --paths (one per line) or found in the
+--sitemap through a running proxy, so its cache is populated before real
+traffic arrives. With --serve the proxy is started in this process, warmed,
+and then kept serving.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (pathsFile == "") == (sitemapURL == "") {
+				return errors.New("exactly one of --paths or --sitemap is required")
+			}
+			cmd.SilenceUsage = true
+			if proxyURL == "" {
+				proxyURL = fmt.Sprintf("http://localhost:%d", port)
+			}
+
+			var requests []warmRequest
+			var err error
+			if pathsFile != "" {
+				requests, err = readWarmPaths(pathsFile, host)
+			} else {
+				requests, err = readSitemap(sitemapURL, host)
+			}
+			if err != nil {
+				return err
+			}
+
+			// Only a proxy started here needs the storage settings; warming
+			// one that is already running just sends it requests.
+			var errCh chan error
+			if serve {
+				config, err := buildConfig()
+				if err != nil {
+					return err
+				}
+				h, err := proxy.NewHandler(config)
+				if err != nil {
+					return err
+				}
+				errCh = make(chan error, 1)
+				go func() {
+					errCh <- h.ListenWithContext(signalContext(cmd.Context()))
+				}()
+				if err := waitForHealthy(proxyURL, 10*time.Second, errCh); err != nil {
+					return err
+				}
+			}
+
+			failures := warm(proxyURL, requests, concurrency)
+			fmt.Printf("Warmed %d of %d paths\n", len(requests)-len(failures), len(requests))
+			for _, f := range failures {
+				fmt.Println("  failed:", f)
+			}
+
+			if serve {
+				return <-errCh
+			}
+			if len(failures) > 0 {
+				return fmt.Errorf("%d of %d paths failed to warm", len(failures), len(requests))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&pathsFile, "paths", "", "file with one path per line")
+	cmd.Flags().StringVar(&sitemapURL, "sitemap", "", "sitemap URL whose <loc> entries are warmed")
+	cmd.Flags().StringVar(&proxyURL, "url", "", "address of the proxy (default http://localhost:<port>)")
+	cmd.Flags().StringVar(&host, "host", "", "Host header to send, e.g. dev.example.com (default the sitemap entry's host)")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "")
+	cmd.Flags().BoolVar(&serve, "serve", false, "start the proxy in this process, warm it and keep serving")
+
+	return cmd
+}
+
+func readWarmPaths(file string, host string) ([]warmRequest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []warmRequest
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			line = "/" + line
+		}
+		requests = append(requests, warmRequest{host: host, path: line})
+	}
+	return requests, scanner.Err()
+}
+
+func readSitemap(sitemapURL string, host string) ([]warmRequest, error) {
+	resp, err := http.Get(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching sitemap", resp.StatusCode)
+	}
+
+	var sitemap struct {
+		URLs []struct {
+			Loc string `xml:"loc"`
+		} `xml:"url"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&sitemap); err != nil {
+		return nil, fmt.Errorf("invalid sitemap: %w", err)
+	}
+
+	var requests []warmRequest
+	for _, u := range sitemap.URLs {
+		loc, err := url.Parse(strings.TrimSpace(u.Loc))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sitemap entry %q: %w", u.Loc, err)
+		}
+		request := warmRequest{host: host, path: loc.RequestURI()}
+		if request.host == "" {
+			request.host = loc.Host
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+func waitForHealthy(proxyURL string, timeout time.Duration, errCh chan error) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-errCh:
+			if err == nil {
+				err = errors.New("proxy stopped before warming")
+			}
+			return err
+		default:
+		}
+		resp, err := http.Get(proxyURL + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("proxy at %s did not become healthy within %s", proxyURL, timeout)
+}
+
+// warm GETs every request through the proxy and returns a description of each
+// one that didn't succeed.
+func warm(proxyURL string, requests []warmRequest, concurrency int) []string {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	client := &http.Client{Timeout: time.Minute}
+
+	var mu sync.Mutex
+	var failures []string
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, r := range requests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r warmRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			failure := warmOne(client, proxyURL, r)
+			if failure != "" {
+				mu.Lock()
+				failures = append(failures, failure)
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	return failures
+}
+
+func warmOne(client *http.Client, proxyURL string, r warmRequest) string {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(proxyURL, "/")+r.path, nil)
+	if err != nil {
+		return fmt.Sprintf("%s: %v", r.path, err)
+	}
+	if r.host != "" {
+		req.Host = r.host
+	}
+	// Warm the variant most browsers will ask for.
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("%s%s: %v", r.host, r.path, err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return fmt.Sprintf("%s%s: %v", r.host, r.path, err)
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Sprintf("%s%s: status %d", r.host, r.path, resp.StatusCode)
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	AccessLogCLF  = "clf"
+	AccessLogJSON = "json"
+)
+
+// cacheRecorder carries the cache outcome of a request back up to the
+// access log, since the cache middleware sits further down the chain.
+type cacheRecorder struct {
+	mu     sync.Mutex
+	result string
+}
+
+type cacheRecorderContextKey struct{}
+
+// recordCacheResult notes how the cache answered req, e.g. hit or miss, for
+// the access log and the request's span. It is a no-op when both are off.
+func recordCacheResult(req *http.Request, result string) {
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("scproxy.cache", result))
+	rec, ok := req.Context().Value(cacheRecorderContextKey{}).(*cacheRecorder)
+	if !ok {
+		return
+	}
+	rec.mu.Lock()
+	rec.result = result
+	rec.mu.Unlock()
+}
+
+func (rec *cacheRecorder) get() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.result == "" {
+		return "-"
+	}
+	return rec.result
+}
+
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId,omitempty"`
+	ClientIP   string    `json:"clientIp"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMs float64   `json:"durationMs"`
+	Cache      string    `json:"cache"`
+}
+
+// AccessLog writes one line per request to w in the given format, clf or
+// json. Status and size are what the client received, after every fallback.
+// It should run after ForwardedHeaders so the client IP is the real one.
+func AccessLog(w io.Writer, format string) (func(next http.Handler) http.Handler, error) {
+	var write func(e accessLogEntry) error
+	switch format {
+	case AccessLogCLF:
+		write = func(e accessLogEntry) error {
+			_, err := fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %d %.3fms cache=%s\n",
+				e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.Path, e.Proto,
+				e.Status, e.Bytes, e.DurationMs, e.Cache)
+			return err
+		}
+	case AccessLogJSON:
+		encoder := json.NewEncoder(w)
+		write = func(e accessLogEntry) error {
+			return encoder.Encode(e)
+		}
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			rec := &cacheRecorder{}
+			ww := middleware.NewWrapResponseWriter(res, req.ProtoMajor)
+			ctx := context.WithValue(req.Context(), cacheRecorderContextKey{}, rec)
+
+			next.ServeHTTP(ww, req.WithContext(ctx))
+
+			clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				clientIP = req.RemoteAddr
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			entry := accessLogEntry{
+				Time:       start,
+				RequestID:  middleware.GetReqID(req.Context()),
+				ClientIP:   clientIP,
+				Method:     req.Method,
+				Path:       req.RequestURI,
+				Proto:      req.Proto,
+				Status:     status,
+				Bytes:      ww.BytesWritten(),
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+				Cache:      rec.get(),
+			}
+
+			mu.Lock()
+			err = write(entry)
+			mu.Unlock()
+			if err != nil {
+				LoggerFromContext(req.Context()).Error("failed to write access log", "err", err)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxAdminBodyBytes bounds the JSON accepted by the admin endpoints.
+const maxAdminBodyBytes = 1 << 20
+
+// RequireAdminToken answers 401 unless the request carries token as a
+// bearer token.
+func RequireAdminToken(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			presented, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				LoggerFromContext(req.Context()).Warn("admin request rejected", "url", req.URL.String(), "client", req.RemoteAddr)
+				res.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(res, req, http.StatusUnauthorized, proxyErrorResponse{Error: "a valid admin token is required"})
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// PurgeHandler drops cached responses for a JSON list of paths, such as
+// ["master/index.html"]. Each path is resolved like a request would be, so a
+// path under one of the prefixes in routes purges it from that container
+// instead of target. A "*" in the list empties the whole cache.
+func PurgeHandler(cache *ResponseCache, target *url.URL, routes map[string]*url.URL) http.HandlerFunc {
+	prefixes := sortedRoutePrefixes(routes)
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		var paths []string
+		if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxAdminBodyBytes)).Decode(&paths); err != nil {
+			writeJSON(res, req, http.StatusBadRequest, proxyErrorResponse{Error: "expected a JSON list of paths"})
+			return
+		}
+
+		purged := 0
+		for _, path := range paths {
+			if path == "*" {
+				n, err := cache.PurgeAll(req.Context())
+				purged += n
+				if err != nil {
+					purgeFailed(res, req, err)
+					return
+				}
+				break
+			}
+			container := target
+			prefix, rest := matchRoutePrefix(prefixes, "/"+strings.TrimPrefix(path, "/"))
+			if prefix != "" {
+				container = routes[prefix]
+			}
+			path = singleJoiningSlash(container.Path, rest)
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				n, err := cache.Purge(req.Context(), method, path)
+				purged += n
+				if err != nil {
+					purgeFailed(res, req, err)
+					return
+				}
+			}
+		}
+
+		LoggerFromContext(req.Context()).Info("purged cache", "paths", paths, "purged", purged)
+		writeJSON(res, req, http.StatusOK, purgeResponse{Purged: purged})
+	}
+}
+
+// InvalidateHandler empties the response cache and, when given, the
+// negative cache, for a deploy pipeline to call once a new version is live.
+func InvalidateHandler(cache *ResponseCache, notFound *NotFoundCache) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		purged, err := cache.PurgeAll(req.Context())
+		if err != nil {
+			purgeFailed(res, req, err)
+			return
+		}
+		if notFound != nil {
+			purged += notFound.PurgeAll()
+		}
+		LoggerFromContext(req.Context()).Info("invalidated cache", "purged", purged)
+		writeJSON(res, req, http.StatusOK, purgeResponse{Purged: purged})
+	}
+}
+
+func purgeFailed(res http.ResponseWriter, req *http.Request, err error) {
+	LoggerFromContext(req.Context()).Error("failed to purge cache", "err", err)
+	writeJSON(res, req, http.StatusInternalServerError, proxyErrorResponse{Error: "failed to purge the cache"})
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeRoutedContainer(t *testing.T) {
+	container := newFakeContainer(map[string]string{
+		"/c/page.html":     "default",
+		"/other/page.html": "routed",
+	})
+	proxy := newTestProxy(t, Config{
+		AdminToken:      "token",
+		CacheTTL:        time.Hour,
+		ContainerRoutes: map[string]string{"app1": "other"},
+	}, container)
+	purge := func(body string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/_scproxy/purge", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("purge %s = %d %s", body, rec.Code, rec.Body.String())
+		}
+	}
+
+	for _, p := range []string{"/page.html", "/app1/page.html"} {
+		get(proxy, p)
+	}
+	container.hits()
+
+	purge(`["app1/page.html"]`)
+	for _, p := range []string{"/page.html", "/app1/page.html"} {
+		get(proxy, p)
+	}
+	// Only the routed container's copy was purged and fetched again.
+	hits := container.hits()
+	if hits["/other/page.html"] != 1 || hits["/c/page.html"] != 0 {
+		t.Errorf("after purging app1/page.html, upstream requests = %v, want /other/page.html once", hits)
+	}
+
+	purge(`["page.html"]`)
+	get(proxy, "/page.html")
+	if hits := container.hits(); hits["/c/page.html"] != 1 {
+		t.Errorf("after purging page.html, upstream requests = %v, want /c/page.html once", hits)
+	}
+}
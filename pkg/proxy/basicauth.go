@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthOptions protects the proxy with a single set of credentials. The
+// password is given either in plain text or as a bcrypt hash. When Paths is
+// empty every path is protected, otherwise only paths under those prefixes.
+type BasicAuthOptions struct {
+	Username     string
+	Password     string
+	PasswordHash string
+	Paths        []string
+	// Realm defaults to the base domain.
+	Realm string
+}
+
+func (o BasicAuthOptions) Enabled() bool {
+	return o.Username != ""
+}
+
+func (o BasicAuthOptions) validate() error {
+	if (o.Password == "") == (o.PasswordHash == "") {
+		return errors.New("basic auth needs exactly one of a password or a password hash")
+	}
+	if o.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(o.PasswordHash)); err != nil {
+			return errors.New("basic auth password hash is not a bcrypt hash")
+		}
+	}
+	return nil
+}
+
+// protects reports whether p is under one of the protected prefixes. p is
+// cleaned first, so spellings such as //preview/x or /./preview/x can't
+// slip past a prefix.
+func (o BasicAuthOptions) protects(p string) bool {
+	if len(o.Paths) == 0 {
+		return true
+	}
+	p = path.Clean("/" + p)
+	for _, prefix := range o.Paths {
+		prefix = normalizeRoutePrefix(prefix)
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (o BasicAuthOptions) authorized(username, password string) bool {
+	userMatches := subtle.ConstantTimeCompare([]byte(username), []byte(o.Username)) == 1
+	var passwordMatches bool
+	if o.PasswordHash != "" {
+		passwordMatches = bcrypt.CompareHashAndPassword([]byte(o.PasswordHash), []byte(password)) == nil
+	} else {
+		passwordMatches = subtle.ConstantTimeCompare([]byte(password), []byte(o.Password)) == 1
+	}
+	return userMatches && passwordMatches
+}
+
+// BasicAuth answers requests to protected paths with a 401 unless they carry
+// the configured credentials.
+func BasicAuth(opts BasicAuthOptions) (func(next http.Handler) http.Handler, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	challenge := `Basic realm="` + strings.ReplaceAll(opts.Realm, `"`, "") + `", charset="UTF-8"`
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if !opts.protects(req.URL.Path) {
+				next.ServeHTTP(res, req)
+				return
+			}
+			username, password, ok := req.BasicAuth()
+			if !ok || !opts.authorized(username, password) {
+				if ok {
+					LoggerFromContext(req.Context()).Warn("basic auth failed", "url", req.URL.String(), "client", req.RemoteAddr, "username", username)
+				}
+				res.Header().Set("WWW-Authenticate", challenge)
+				http.Error(res, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}, nil
+}
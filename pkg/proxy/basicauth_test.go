@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthProtects(t *testing.T) {
+	opts := BasicAuthOptions{Paths: []string{"preview/"}}
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{path: "/preview", want: true},
+		{path: "/preview/", want: true},
+		{path: "/preview/x", want: true},
+		{path: "//preview/x", want: true},
+		{path: "/./preview/x", want: true},
+		{path: "/public/../preview/x", want: true},
+		{path: "preview/x", want: true},
+		{path: "/previews/x", want: false},
+		{path: "/public/preview/x", want: false},
+		{path: "/", want: false},
+	} {
+		if got := opts.protects(tc.path); got != tc.want {
+			t.Errorf("protects(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+	if !(BasicAuthOptions{}).protects("/anything") {
+		t.Error("no paths should protect every path")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []BasicAuthOptions{
+		{Username: "admin", Password: "hunter2", Realm: "example.com"},
+		{Username: "admin", PasswordHash: string(hash), Realm: "example.com"},
+	} {
+		auth, err := BasicAuth(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := auth(echoPath)
+		for _, tc := range []struct {
+			name     string
+			username string
+			password string
+			want     int
+		}{
+			{name: "no credentials", want: http.StatusUnauthorized},
+			{name: "wrong password", username: "admin", password: "hunter3", want: http.StatusUnauthorized},
+			{name: "wrong username", username: "root", password: "hunter2", want: http.StatusUnauthorized},
+			{name: "right credentials", username: "admin", password: "hunter2", want: http.StatusOK},
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			if tc.username != "" {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("%s = %d, want %d", tc.name, rec.Code, tc.want)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); tc.want == http.StatusUnauthorized && challenge != `Basic realm="example.com", charset="UTF-8"` {
+				t.Errorf("%s challenge = %q", tc.name, challenge)
+			}
+		}
+	}
+}
+
+func TestBasicAuthInvalidOptions(t *testing.T) {
+	for _, opts := range []BasicAuthOptions{
+		{Username: "admin"},
+		{Username: "admin", Password: "a", PasswordHash: "b"},
+		{Username: "admin", PasswordHash: "not a hash"},
+	} {
+		if _, err := BasicAuth(opts); err == nil {
+			t.Errorf("%+v was accepted, want an error", opts)
+		}
+	}
+}
+
+func TestBasicAuthProtectsOperationalRoutes(t *testing.T) {
+	proxy := newTestProxy(t, Config{
+		Debug:         true,
+		StatsEndpoint: true,
+		Metrics:       true,
+		BasicAuth:     BasicAuthOptions{Username: "admin", Password: "hunter2"},
+	}, newFakeContainer(nil))
+	for _, p := range []string{"/metrics", "/_scproxy/stats", "/_scproxy/config", "/_scproxy/explain?url=/x"} {
+		if rec := get(proxy, p); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without credentials = %d, want 401", p, rec.Code)
+		}
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.SetBasicAuth("admin", "hunter2")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s with credentials = %d, want 200", p, rec.Code)
+		}
+	}
+	if rec := get(proxy, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("/healthz without credentials = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxBlobListPage is the most entries blob storage returns per list request.
+const maxBlobListPage = 5000
+
+// BlobEntry is a blob in a container listing.
+type BlobEntry struct {
+	Name string
+	Size int64
+	// ContentMD5 is the base64 MD5 blob storage holds for the blob, empty
+	// when none was set on upload.
+	ContentMD5   string
+	LastModified time.Time
+}
+
+// blobListPage is one page of a List Blobs response.
+type blobListPage struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string `xml:"Name"`
+			Properties struct {
+				ContentLength int64  `xml:"Content-Length"`
+				ContentMD5    string `xml:"Content-MD5"`
+				LastModified  string `xml:"Last-Modified"`
+			} `xml:"Properties"`
+		} `xml:"Blob"`
+		BlobPrefix []struct {
+			Name string `xml:"Name"`
+		} `xml:"BlobPrefix"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ListBlobs lists the blobs in container whose names start with prefix,
+// following continuation markers across pages. It stops after maxEntries
+// blobs, or lists them all when maxEntries is zero. client should be the
+// authenticated upstream client, whose credentials need list permission on
+// the container.
+func ListBlobs(ctx context.Context, container *url.URL, prefix string, maxEntries int, client *http.Client) ([]BlobEntry, error) {
+	blobs, _, err := listBlobs(ctx, container, prefix, "", maxEntries, client)
+	return blobs, err
+}
+
+// listBlobs lists the blobs under prefix in container. With a delimiter,
+// blobs further down are rolled up into the virtual directory names returned
+// alongside, as the List Blobs API does, and count towards maxEntries.
+func listBlobs(ctx context.Context, container *url.URL, prefix string, delimiter string, maxEntries int, client *http.Client) ([]BlobEntry, []string, error) {
+	var blobs []BlobEntry
+	var dirs []string
+	marker := ""
+	for {
+		pageSize := maxBlobListPage
+		if remaining := maxEntries - len(blobs) - len(dirs); maxEntries > 0 && remaining < pageSize {
+			pageSize = remaining
+		}
+		page, err := listBlobPage(ctx, container, prefix, delimiter, marker, pageSize, client)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, b := range page.Blobs.Blob {
+			entry := BlobEntry{
+				Name:       b.Name,
+				Size:       b.Properties.ContentLength,
+				ContentMD5: b.Properties.ContentMD5,
+			}
+			if b.Properties.LastModified != "" {
+				entry.LastModified, err = http.ParseTime(b.Properties.LastModified)
+				if err != nil {
+					return nil, nil, fmt.Errorf("blob %s: %w", b.Name, err)
+				}
+			}
+			blobs = append(blobs, entry)
+		}
+		for _, p := range page.Blobs.BlobPrefix {
+			dirs = append(dirs, p.Name)
+		}
+		if maxEntries > 0 && len(blobs)+len(dirs) >= maxEntries {
+			if len(blobs) > maxEntries {
+				blobs = blobs[:maxEntries]
+			}
+			if len(dirs) > maxEntries-len(blobs) {
+				dirs = dirs[:maxEntries-len(blobs)]
+			}
+			return blobs, dirs, nil
+		}
+		if page.NextMarker == "" {
+			return blobs, dirs, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func listBlobPage(ctx context.Context, container *url.URL, prefix string, delimiter string, marker string, pageSize int, client *http.Client) (*blobListPage, error) {
+	query := url.Values{
+		"restype":    {"container"},
+		"comp":       {"list"},
+		"maxresults": {strconv.Itoa(pageSize)},
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	listURL := *container
+	listURL.RawPath = ""
+	listURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	setClientRequestID(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing blobs answered %d", resp.StatusCode)
+	}
+
+	var page blobListPage
+	if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("decoding blob list: %w", err)
+	}
+	return &page, nil
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// blobListPages serves a List Blobs response per marker, the first page for
+// no marker, and records the queries it was sent.
+type blobListPages struct {
+	pages   map[string]string
+	queries []url.Values
+}
+
+func (p *blobListPages) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	p.queries = append(p.queries, query)
+	page, ok := p.pages[query.Get("marker")]
+	if !ok || query.Get("restype") != "container" || query.Get("comp") != "list" {
+		http.Error(res, "unexpected list request", http.StatusBadRequest)
+		return
+	}
+	res.Header().Set("Content-Type", "application/xml")
+	res.Write([]byte(page))
+}
+
+func listBlobsFrom(t *testing.T, pages map[string]string, prefix string, maxEntries int) ([]BlobEntry, []url.Values, error) {
+	t.Helper()
+	upstream := &blobListPages{pages: pages}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	container, err := url.Parse(server.URL + "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := ListBlobs(context.Background(), container, prefix, maxEntries, server.Client())
+	return blobs, upstream.queries, err
+}
+
+func TestListBlobs(t *testing.T) {
+	pages := map[string]string{
+		"": `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ContainerName="c">
+  <Prefix>assets/</Prefix>
+  <MaxResults>5000</MaxResults>
+  <Blobs>
+    <Blob>
+      <Name>assets/app.js</Name>
+      <Properties>
+        <Last-Modified>Tue, 02 Jan 2024 15:04:05 GMT</Last-Modified>
+        <Content-Length>2048</Content-Length>
+        <Content-Type>text/javascript</Content-Type>
+        <Content-MD5>XrY7u+Ae7tCTyyK7j1rNww==</Content-MD5>
+      </Properties>
+    </Blob>
+  </Blobs>
+  <NextMarker>2!88!token</NextMarker>
+</EnumerationResults>`,
+		"2!88!token": `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ContainerName="c">
+  <Blobs>
+    <Blob>
+      <Name>assets/app.css</Name>
+      <Properties>
+        <Content-Length>512</Content-Length>
+      </Properties>
+    </Blob>
+  </Blobs>
+  <NextMarker />
+</EnumerationResults>`,
+	}
+
+	blobs, queries, err := listBlobsFrom(t, pages, "assets/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BlobEntry{
+		{
+			Name:         "assets/app.js",
+			Size:         2048,
+			ContentMD5:   "XrY7u+Ae7tCTyyK7j1rNww==",
+			LastModified: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+		},
+		{Name: "assets/app.css", Size: 512},
+	}
+	if !reflect.DeepEqual(blobs, want) {
+		t.Errorf("ListBlobs = %+v, want %+v", blobs, want)
+	}
+	if len(queries) != 2 || queries[0].Get("prefix") != "assets/" || queries[1].Get("marker") != "2!88!token" {
+		t.Errorf("list requests = %v, want the first page then the continuation marker, under assets/", queries)
+	}
+}
+
+func TestListBlobsErrors(t *testing.T) {
+	for name, pages := range map[string]map[string]string{
+		"error status":      {},
+		"malformed xml":     {"": "<EnumerationResults><Blobs>"},
+		"bad last modified": {"": `<EnumerationResults><Blobs><Blob><Name>x</Name><Properties><Last-Modified>yesterday</Last-Modified></Properties></Blob></Blobs></EnumerationResults>`},
+	} {
+		if blobs, _, err := listBlobsFrom(t, pages, "", 0); err == nil {
+			t.Errorf("%s: ListBlobs = %v, want an error", name, blobs)
+		}
+	}
+}
+
+// namedBlobPage is a List Blobs page holding blobs with names, continued at
+// next unless that is empty.
+func namedBlobPage(next string, names ...string) string {
+	page := `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`
+	for _, name := range names {
+		page += "<Blob><Name>" + name + "</Name><Properties><Content-Length>1</Content-Length></Properties></Blob>"
+	}
+	return page + "</Blobs><NextMarker>" + next + "</NextMarker></EnumerationResults>"
+}
+
+func TestListBlobsPagination(t *testing.T) {
+	pages := map[string]string{
+		"":      namedBlobPage("page2", "a", "b", "c"),
+		"page2": namedBlobPage("", "d", "e"),
+	}
+	names := func(blobs []BlobEntry) []string {
+		var names []string
+		for _, b := range blobs {
+			names = append(names, b.Name)
+		}
+		return names
+	}
+
+	for _, tc := range []struct {
+		maxEntries int
+		want       []string
+		// maxResults is what each request asked blob storage for.
+		maxResults []string
+	}{
+		{maxEntries: 0, want: []string{"a", "b", "c", "d", "e"}, maxResults: []string{"5000", "5000"}},
+		{maxEntries: 10, want: []string{"a", "b", "c", "d", "e"}, maxResults: []string{"10", "7"}},
+		{maxEntries: 4, want: []string{"a", "b", "c", "d"}, maxResults: []string{"4", "1"}},
+		{maxEntries: 3, want: []string{"a", "b", "c"}, maxResults: []string{"3"}},
+		{maxEntries: 2, want: []string{"a", "b"}, maxResults: []string{"2"}},
+	} {
+		blobs, queries, err := listBlobsFrom(t, pages, "", tc.maxEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(blobs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("max %d: ListBlobs = %q, want %q", tc.maxEntries, got, tc.want)
+		}
+		var maxResults []string
+		for _, query := range queries {
+			maxResults = append(maxResults, query.Get("maxresults"))
+		}
+		if !reflect.DeepEqual(maxResults, tc.maxResults) {
+			t.Errorf("max %d: requested pages of %q, want %q", tc.maxEntries, maxResults, tc.maxResults)
+		}
+	}
+}
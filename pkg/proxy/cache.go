@@ -1,39 +1,87 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/tls"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
-func CheckUrlMD5(target *url.URL) (string, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+func CheckUrlMD5(ctx context.Context, target *url.URL, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+	if err != nil {
+		return "", err
 	}
-	resp, err := client.Head(target.String())
+	setClientRequestID(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
 	contentMd5 := resp.Header["Content-Md5"]
 	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d checking md5", resp.StatusCode)
+	}
 	if len(contentMd5) != 1 {
 		return "", errors.New("no md5 present")
 	}
 	return contentMd5[0], nil
 }
 
+// CheckUrlNotModified issues a conditional GET for target and reports whether
+// the upstream still matches etag.
+func CheckUrlNotModified(ctx context.Context, target *url.URL, etag string, client *http.Client) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("If-None-Match", etag)
+	setClientRequestID(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return true, nil
+	case http.StatusOK:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %d revalidating etag", resp.StatusCode)
+}
+
 type CachedResponseWriter struct {
 	StatusCode int
 	header     http.Header
 	Buffer     bytes.Buffer
+
+	// When maxBufferBytes is positive, a response growing past it is
+	// committed: everything buffered so far is flushed to underlying and
+	// later writes stream straight through, giving up on any retry. A Flush
+	// commits the same way, and Hijack hands over underlying's connection.
+	underlying     http.ResponseWriter
+	maxBufferBytes int64
+	committed      bool
+
+	rewriteHeaders []func(http.Header)
 }
 
 func NewCachedResponseWriter() *CachedResponseWriter {
@@ -44,99 +92,1026 @@ func NewCachedResponseWriter() *CachedResponseWriter {
 	}
 }
 
+// NewLimitedResponseWriter buffers at most maxBufferBytes before streaming
+// the rest of the response to res.
+func NewLimitedResponseWriter(res http.ResponseWriter, maxBufferBytes int64) *CachedResponseWriter {
+	w := NewCachedResponseWriter()
+	w.underlying = res
+	w.maxBufferBytes = maxBufferBytes
+	return w
+}
+
 func (srrw *CachedResponseWriter) Header() http.Header {
 	return srrw.header
 }
 
 func (srrw *CachedResponseWriter) Write(bytes []byte) (int, error) {
+	if srrw.committed {
+		return srrw.underlying.Write(bytes)
+	}
+	if srrw.underlying != nil && srrw.maxBufferBytes > 0 && int64(srrw.Buffer.Len()+len(bytes)) > srrw.maxBufferBytes {
+		if err := srrw.commit(); err != nil {
+			return 0, err
+		}
+		return srrw.underlying.Write(bytes)
+	}
 	return srrw.Buffer.Write(bytes)
 }
 
 func (srrw *CachedResponseWriter) WriteHeader(code int) {
+	if srrw.committed {
+		return
+	}
 	srrw.StatusCode = code
 }
 
-func (srrw CachedResponseWriter) WriteTo(res http.ResponseWriter) error {
+// Committed reports whether the response has already been sent to the
+// underlying writer, in which case it can no longer be retried or cached.
+func (srrw *CachedResponseWriter) Committed() bool {
+	return srrw.committed
+}
+
+// Flush commits the response so a streaming response, such as server-sent
+// events, reaches the client as it is written rather than once complete.
+// Without an underlying writer there is nothing to flush to.
+func (srrw *CachedResponseWriter) Flush() {
+	if srrw.underlying == nil {
+		return
+	}
+	if !srrw.committed {
+		if err := srrw.commit(); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(srrw.underlying).Flush()
+}
+
+// Hijack takes over the underlying connection for protocol upgrades such as
+// WebSockets, discarding anything buffered.
+func (srrw *CachedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if srrw.underlying == nil {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := http.NewResponseController(srrw.underlying).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	srrw.committed = true
+	srrw.Buffer = bytes.Buffer{}
+	return conn, rw, nil
+}
+
+func (srrw *CachedResponseWriter) commit() error {
+	srrw.committed = true
+	err := srrw.copyTo(srrw.underlying, false)
+	srrw.Buffer = bytes.Buffer{}
+	return err
+}
+
+// WriteTo sends the buffered response to res, with a Content-Length that
+// matches the buffered body whatever the headers said before they or the
+// body were rewritten.
+func (srrw *CachedResponseWriter) WriteTo(res http.ResponseWriter) error {
+	if srrw.committed {
+		return nil
+	}
+	return srrw.copyTo(res, true)
+}
+
+// RewriteHeaders registers fn to adjust the headers right before they are
+// sent, whether that is from WriteTo or because the response was committed.
+func (srrw *CachedResponseWriter) RewriteHeaders(fn func(http.Header)) {
+	srrw.rewriteHeaders = append(srrw.rewriteHeaders, fn)
+}
+
+// copyTo sends the headers and buffered body to res. complete is false when
+// the rest of the body is still to be streamed, and the upstream
+// Content-Length is all there is to go by.
+func (srrw *CachedResponseWriter) copyTo(res http.ResponseWriter, complete bool) error {
+	for _, fn := range srrw.rewriteHeaders {
+		fn(srrw.header)
+	}
 	for k, v := range srrw.header {
 		for _, s := range v {
 			res.Header().Add(k, s)
 		}
 	}
+	if complete {
+		setContentLength(res.Header(), srrw.StatusCode, srrw.Buffer.Len())
+	}
 	res.WriteHeader(srrw.StatusCode)
+	if !complete {
+		// Once one layer streams, the buffering layers around it can't
+		// retry the response either. Flushing commits them before the body
+		// is written, so it passes through rather than into their buffers.
+		http.NewResponseController(res).Flush()
+	}
 	_, err := res.Write(srrw.Buffer.Bytes())
 	return err
 }
 
+// setContentLength sets header's Content-Length to the length of a complete
+// body. It is set on the outgoing headers rather than the buffered ones, which
+// cached responses share between requests. A chunked response drops it. HEAD
+// responses are buffered without a body but keep the length of the body they
+// describe, so an empty body leaves it alone, as do statuses without one.
+func setContentLength(header http.Header, status int, length int) {
+	if header.Get("Transfer-Encoding") != "" {
+		header.Del("Content-Length")
+		return
+	}
+	if length == 0 || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(length))
+}
+
+type bufferLimitContextKey struct{}
+
+// LimitBuffering caps how much of a response each buffering middleware holds
+// in memory. Responses larger than maxBufferBytes are streamed to the client
+// and skip the fallback and cache logic. Only the innermost middleware
+// buffers them, the ones around it stream from the moment it does.
+func LimitBuffering(maxBufferBytes int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), bufferLimitContextKey{}, maxBufferBytes)
+			next.ServeHTTP(res, req.WithContext(ctx))
+		})
+	}
+}
+
+// newBufferedWriter returns a writer buffering for res, limited according to
+// LimitBuffering if it is in the chain. Either way it can be flushed or
+// hijacked through to res.
+func newBufferedWriter(res http.ResponseWriter, req *http.Request) *CachedResponseWriter {
+	limit, _ := req.Context().Value(bufferLimitContextKey{}).(int64)
+	return NewLimitedResponseWriter(res, limit)
+}
+
 type CachedResponse struct {
-	md5     string
-	value   *CachedResponseWriter
-	checked time.Time
+	method string
+	key    string
+	md5    string
+	etag   string
+	// upstream is the blob the response was resolved from, which differs
+	// from the requested path when a fallback served it.
+	upstream *url.URL
+	value    *CachedResponseWriter
+	gzipped  *CachedResponseWriter // value compressed once, nil if not compressible
+	checked  time.Time
+	size     int64
+	// element is the entry's place in the memory or disk cache's LRU list,
+	// which also tells a copy of the entry from its replacement.
+	element *list.Element
+}
+
+// Cache stores the entries of a ResponseCache, which does the fetching,
+// revalidating and compressing around it. Get returns a copy of the entry,
+// so the caller can update it without racing other requests, and Touch
+// writes the revalidation time back.
+type Cache interface {
+	// Get returns the entry for method and key, or nil when there is none.
+	Get(ctx context.Context, method string, key string) (*CachedResponse, error)
+	// Put stores r, replacing any entry for the same method and key.
+	Put(ctx context.Context, r *CachedResponse) error
+	// Touch records r.checked for the stored entry r was read from.
+	Touch(ctx context.Context, r *CachedResponse) error
+	// Delete drops the entry r was read from. The memory cache keeps an
+	// entry that has since been replaced.
+	Delete(ctx context.Context, r *CachedResponse) error
+	// Purge and PurgeAll implement ResponseCache's methods of the same name.
+	Purge(ctx context.Context, method string, path string) (int, error)
+	PurgeAll(ctx context.Context) (int, error)
+}
+
+// entryKey is the key a Cache stores an entry under.
+func entryKey(method string, key string) string {
+	return method + " " + key
+}
+
+// entryMeta is what stores outside process memory keep of an entry besides
+// its bodies and revalidation time, encoded as JSON.
+type entryMeta struct {
+	Method        string      `json:"method"`
+	Key           string      `json:"key"`
+	MD5           string      `json:"md5,omitempty"`
+	ETag          string      `json:"etag,omitempty"`
+	Upstream      string      `json:"upstream"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	GzippedHeader http.Header `json:"gzippedHeader,omitempty"`
+	Size          int64       `json:"size"`
+}
+
+func newEntryMeta(r *CachedResponse) entryMeta {
+	meta := entryMeta{
+		Method:   r.method,
+		Key:      r.key,
+		MD5:      r.md5,
+		ETag:     r.etag,
+		Upstream: r.upstream.String(),
+		Status:   r.value.StatusCode,
+		Header:   r.value.Header(),
+		Size:     r.size,
+	}
+	if r.gzipped != nil {
+		meta.GzippedHeader = r.gzipped.Header()
+	}
+	return meta
+}
+
+// entry rebuilds the entry m describes. gzipped is ignored unless the entry
+// had a compressed copy.
+func (m entryMeta) entry(checked time.Time, body []byte, gzipped []byte) (*CachedResponse, error) {
+	upstream, err := url.Parse(m.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("decoding cache entry: %w", err)
+	}
+	r := &CachedResponse{
+		method:   m.Method,
+		key:      m.Key,
+		md5:      m.MD5,
+		etag:     m.ETag,
+		upstream: upstream,
+		value:    newStoredResponse(m.Status, m.Header, body),
+		checked:  checked,
+		size:     m.Size,
+	}
+	if m.GzippedHeader != nil {
+		r.gzipped = newStoredResponse(m.Status, m.GzippedHeader, gzipped)
+	}
+	return r, nil
+}
+
+func newStoredResponse(status int, header http.Header, body []byte) *CachedResponseWriter {
+	w := NewCachedResponseWriter()
+	w.StatusCode = status
+	w.header = header
+	w.Buffer.Write(body)
+	return w
+}
+
+// purgeMatches reports whether Purge(method, path) drops r. escaped is path
+// as escaped in cache keys.
+func purgeMatches(r *CachedResponse, method string, path string, escaped string) bool {
+	if r.method != method {
+		return false
+	}
+	requested, _, _ := strings.Cut(strings.SplitN(r.key, "|", 2)[0], "?")
+	return requested == escaped || (r.upstream != nil && r.upstream.Path == path)
+}
+
+type CacheOptions struct {
+	// EntryLifetime has the same semantics as Config.CacheTTL.
+	EntryLifetime time.Duration
+	// ErrorBackoff has the same semantics as Config.CacheErrorBackoff, except
+	// that zero retries on every request.
+	ErrorBackoff time.Duration
+	// StaleWhileRevalidate has the same semantics as the Config field.
+	StaleWhileRevalidate bool
+	// MaxBytes caps the summed body size of all entries, zero is unbounded.
+	MaxBytes int64
+	// MaxEntries caps the number of entries, zero is unbounded.
+	MaxEntries int
+	// GzipLevel compresses each entry of a CompressibleTypes type once at
+	// this level, so hits from clients accepting gzip are served without
+	// compressing the body again. Zero disables it. CompressibleTypes
+	// defaults to the same list as chi's Compress middleware.
+	GzipLevel         int
+	CompressibleTypes []string
+	// CacheableStatusCodes defaults to only caching 200 responses.
+	CacheableStatusCodes []int
+	// CacheableMethods defaults to only caching GET requests.
+	CacheableMethods []string
+	Logger           Logger
+	// Store keeps the entries, and defaults to an in-memory LRU bounded by
+	// MaxBytes and MaxEntries. Other stores still skip single responses
+	// larger than MaxBytes.
+	Store Cache
 }
 
+type CacheBackend string
+
+const (
+	// CacheBackendMemory keeps cached responses in each replica's memory.
+	CacheBackendMemory CacheBackend = "memory"
+	// CacheBackendRedis shares cached responses between replicas in Redis.
+	CacheBackendRedis CacheBackend = "redis"
+	// CacheBackendNone stores nothing, see NoopCache.
+	CacheBackendNone CacheBackend = "none"
+	// CacheBackendDisk keeps cached responses in files, see DiskCache.
+	CacheBackendDisk CacheBackend = "disk"
+)
+
+func ParseCacheBackend(s string) (CacheBackend, error) {
+	switch backend := CacheBackend(strings.ToLower(s)); backend {
+	case CacheBackendMemory, CacheBackendRedis, CacheBackendNone, CacheBackendDisk:
+		return backend, nil
+	}
+	return "", fmt.Errorf("unknown cache backend %q", s)
+}
+
+// maxBackgroundRevalidations bounds the blob storage requests that
+// stale-while-revalidate can have in flight at once.
+const maxBackgroundRevalidations = 16
+
 type ResponseCache struct {
-	cache         map[string]map[string]*CachedResponse
+	store         Cache
 	entryLifetime time.Duration
+	errorBackoff  time.Duration
+	serveStale    bool
+	revalidations chan struct{}
+	maxBytes      int64
+	cacheable     map[int]bool
+	methods       map[string]bool
+	gzipLevel     int
+	compressible  contentTypeSet
+	client        *http.Client
+	logger        Logger
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+	// revalidating holds the entry keys being revalidated in the
+	// background, so each is only revalidated once at a time.
+	revalidating map[string]bool
+	fetches      map[string]*inflightFetch
+}
+
+// inflightFetch is a cache miss being fetched, which concurrent misses for
+// the same key wait for instead of fetching it again.
+type inflightFetch struct {
+	done chan struct{}
+	// res is the fetched response, or nil when it was streamed to the
+	// first client and the others have to fetch it themselves.
+	res *CachedResponseWriter
 }
 
-func NewMd5ResponseCache(entryLifetime time.Duration) *ResponseCache {
+// wait blocks until the fetch finishes or ctx is done, and returns the
+// response to share, if any.
+func (f *inflightFetch) wait(ctx context.Context) *CachedResponseWriter {
+	select {
+	case <-f.done:
+		return f.res
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// startFetch returns the fetch in flight for key, or starts one and reports
+// first, in which case the caller must finish it with finishFetch.
+func (c *ResponseCache) startFetch(key string) (*inflightFetch, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f := c.fetches[key]; f != nil {
+		return f, false
+	}
+	f := &inflightFetch{done: make(chan struct{})}
+	c.fetches[key] = f
+	return f, true
+}
+
+// finishFetch releases the requests waiting on f, sharing w unless it was
+// streamed. Only the first call for f has any effect.
+func (c *ResponseCache) finishFetch(key string, f *inflightFetch, w *CachedResponseWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fetches[key] != f {
+		return
+	}
+	delete(c.fetches, key)
+	if w != nil && !w.Committed() {
+		f.res = w
+	}
+	close(f.done)
+}
+
+func NewMd5ResponseCache(options CacheOptions, client *http.Client) *ResponseCache {
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	cacheable := make(map[int]bool)
+	for _, code := range options.CacheableStatusCodes {
+		cacheable[code] = true
+	}
+	if len(cacheable) == 0 {
+		cacheable[http.StatusOK] = true
+	}
+	methods := make(map[string]bool)
+	for _, method := range options.CacheableMethods {
+		methods[strings.ToUpper(method)] = true
+	}
+	if len(methods) == 0 {
+		methods[http.MethodGet] = true
+	}
+
+	store := options.Store
+	if store == nil {
+		store = newMemoryCache(options.MaxBytes, options.MaxEntries, logger)
+	}
+
 	return &ResponseCache{
-		cache: make(map[string]map[string]*CachedResponse),
-		entryLifetime: entryLifetime,
+		store:         store,
+		entryLifetime: options.EntryLifetime,
+		errorBackoff:  options.ErrorBackoff,
+		serveStale:    options.StaleWhileRevalidate,
+		revalidations: make(chan struct{}, maxBackgroundRevalidations),
+		maxBytes:      options.MaxBytes,
+		cacheable:     cacheable,
+		methods:       methods,
+		gzipLevel:     options.GzipLevel,
+		compressible:  newContentTypeSet(options.CompressibleTypes),
+		client:        client,
+		logger:        logger,
+		revalidating:  make(map[string]bool),
+		fetches:       make(map[string]*inflightFetch),
 	}
 }
 
-func (c *ResponseCache) get(method string, target *url.URL) *CachedResponseWriter {
-	if method != http.MethodGet {
+// cacheKey identifies a cached response by its full upstream path and query.
+// Responses that vary by Accept-Encoding, such as precompressed variants,
+// are also keyed by the encodings the client accepts, while the rest are
+// stored once and compressed by the cache itself.
+func cacheKey(target *url.URL, acceptEncoding string) string {
+	var encodings []string
+	for _, e := range strings.Split(acceptEncoding, ",") {
+		if i := strings.Index(e, ";"); i >= 0 {
+			e = e[:i]
+		}
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "" {
+			encodings = append(encodings, e)
+		}
+	}
+	sort.Strings(encodings)
+
+	key := target.EscapedPath()
+	if target.RawQuery != "" {
+		key += "?" + target.RawQuery
+	}
+	return key + "|" + strings.Join(encodings, ",")
+}
+
+// get returns the cached response for target, compressed when the client
+// accepts gzip and a compressed copy is cached.
+func (c *ResponseCache) get(ctx context.Context, method string, target *url.URL, acceptEncoding string) *CachedResponseWriter {
+	r := c.lookup(ctx, method, target, acceptEncoding)
+	if r == nil {
 		return nil
 	}
+	if r.gzipped != nil && acceptedEncodings(acceptEncoding)["gzip"] {
+		return r.gzipped
+	}
+	return r.value
+}
 
-	if c.cache[method] == nil {
-		c.cache[method] = make(map[string]*CachedResponse)
+// Cacheable reports whether responses to method are cached.
+func (c *ResponseCache) Cacheable(method string) bool {
+	return c.methods[method]
+}
+
+// lookup revalidates a stale entry with ctx's request ID but not its
+// cancellation, since a client going away isn't a failed revalidation.
+func (c *ResponseCache) lookup(ctx context.Context, method string, target *url.URL, acceptEncoding string) *CachedResponse {
+	ctx = context.WithoutCancel(ctx)
+
+	if !c.methods[method] {
 		return nil
 	}
-	r := c.cache[method][target.Path]
+
+	r := c.find(ctx, method, cacheKey(target, ""))
 	if r == nil {
+		r = c.find(ctx, method, cacheKey(target, acceptEncoding))
+	}
+	if r == nil {
+		countCacheLookup("miss")
 		return nil
 	}
+	fresh := c.entryLifetime < 0 || time.Now().Sub(r.checked) < c.entryLifetime
+	if !fresh && c.serveStale {
+		c.revalidateInBackground(ctx, r)
+		fresh = true
+	}
 
-	if time.Now().Sub(r.checked) < c.entryLifetime {
-		return r.value
+	if fresh {
+		countCacheLookup("hit")
+		return r
 	}
 
-	urlMd5, err := CheckUrlMD5(target)
-	log.Printf("[INFO] ResponseCache::get md5 for: %s is %s\n", target.String(), urlMd5)
-	if err != nil {
-		log.Printf("[ERROR] ResponseCache::get %v\n", err)
-		return r.value
+	unchanged, err := c.revalidate(ctx, r)
+	if !c.updateRevalidated(ctx, r, unchanged, err) {
+		countCacheLookup("miss")
+		return nil
 	}
+	countCacheLookup("hit")
+	return r
+}
 
-	if r.md5 != urlMd5 {
-		c.cache[method][target.Path] = nil
-		log.Printf("[WARN] ResponseCache::get md5 mismatch: %s != %s -- updating\n", r.md5, urlMd5)
+// find returns the stored entry for method and key, treating a store that
+// fails as a miss.
+func (c *ResponseCache) find(ctx context.Context, method string, key string) *CachedResponse {
+	r, err := c.store.Get(ctx, method, key)
+	if err != nil {
+		c.logger.Error("cache lookup failed", "method", method, "key", key, "err", err)
 		return nil
 	}
+	return r
+}
+
+// revalidateInBackground revalidates r without holding up the request that
+// found it stale. At most one revalidation runs per entry and at most
+// maxBackgroundRevalidations overall; beyond that a later request retries.
+func (c *ResponseCache) revalidateInBackground(ctx context.Context, r *CachedResponse) {
+	key := entryKey(r.method, r.key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.revalidating[key] {
+		return
+	}
+	select {
+	case c.revalidations <- struct{}{}:
+	default:
+		return
+	}
+	c.revalidating[key] = true
 
-	r.checked = time.Now()
+	go func() {
+		defer func() { <-c.revalidations }()
+		unchanged, err := c.revalidate(ctx, r)
+		c.updateRevalidated(ctx, r, unchanged, err)
 
-	return r.value
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.revalidating, key)
+	}()
+}
+
+// updateRevalidated records the outcome of revalidating r and reports
+// whether r can still be served. When revalidation failed the stale entry
+// is kept, and treated as fresh until errorBackoff has passed rather than
+// revalidated again on the next request.
+func (c *ResponseCache) updateRevalidated(ctx context.Context, r *CachedResponse, unchanged bool, err error) bool {
+	switch {
+	case err != nil:
+		c.logger.Error("cache revalidation failed", "url", r.upstream.String(), "err", err, "retryIn", c.errorBackoff)
+		r.checked = time.Now().Add(c.errorBackoff - c.entryLifetime)
+	case !unchanged:
+		if err := c.store.Delete(ctx, r); err != nil {
+			c.logger.Error("failed to drop cache entry", "url", r.upstream.String(), "err", err)
+		}
+		return false
+	default:
+		r.checked = time.Now()
+	}
+	if err := c.store.Touch(ctx, r); err != nil {
+		c.logger.Error("failed to update cache entry", "url", r.upstream.String(), "err", err)
+	}
+	return true
 }
 
-func (c *ResponseCache) put(method string, target *url.URL, w *CachedResponseWriter) {
-	if c.cache[method] == nil {
-		c.cache[method] = make(map[string]*CachedResponse)
+// revalidate checks whether the upstream still serves the cached entry,
+// preferring a conditional GET on the ETag so an unchanged blob costs a 304.
+func (c *ResponseCache) revalidate(ctx context.Context, r *CachedResponse) (bool, error) {
+	target := r.upstream
+	if r.etag != "" {
+		notModified, err := CheckUrlNotModified(ctx, target, r.etag, c.client)
+		if err != nil {
+			return false, err
+		}
+		if !notModified {
+			c.logger.Info("etag no longer matches, updating", "url", target.String(), "etag", r.etag)
+		}
+		return notModified, nil
 	}
 
-	contentMd5 := w.Header()["Content-Md5"]
-	log.Printf("[INFO] response headers are: %v\n", w.Header())
-	log.Printf("[INFO] found md5 for: %s is %s\n", target.Path, contentMd5)
-	if len(contentMd5) != 1 {
-		log.Printf("[INFO] len was %d\n", len(contentMd5))
+	urlMd5, err := CheckUrlMD5(ctx, target, c.client)
+	c.logger.Debug("revalidated md5", "url", target.String(), "md5", urlMd5)
+	if err != nil {
+		return false, err
+	}
+	if r.md5 != urlMd5 {
+		c.logger.Info("md5 mismatch, updating", "url", target.String(), "cached", r.md5, "upstream", urlMd5)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (c *ResponseCache) put(ctx context.Context, method string, target *url.URL, upstream *url.URL, acceptEncoding string, w *CachedResponseWriter) {
+	if !c.methods[method] {
+		return
+	}
+	if w.Committed() {
+		c.logger.Debug("response was streamed, not caching", "path", target.Path)
+		return
+	}
+	if !c.cacheable[w.StatusCode] {
+		c.logger.Debug("not caching response status", "path", target.Path, "status", w.StatusCode)
+		return
+	}
+	if isUncacheable(w.Header()) {
+		c.logger.Debug("not caching due to Cache-Control", "path", target.Path, "cacheControl", w.Header().Get("Cache-Control"))
 		return
 	}
+
+	contentMd5 := w.Header().Get("Content-Md5")
+	etag := w.Header().Get("ETag")
+	c.logger.Debug("found cache validators", "path", target.Path, "md5", contentMd5, "etag", etag)
+	if contentMd5 == "" && etag == "" {
+		c.logger.Debug("no md5 or etag to revalidate with, not caching", "path", target.Path)
+		return
+	}
+
+	if method == http.MethodGet && contentMd5 != "" {
+		if bodyMd5, ok := matchesContentMd5(w, contentMd5); !ok {
+			c.logger.Warn("body does not match Content-MD5, not caching", "path", target.Path, "declared", contentMd5, "actual", bodyMd5)
+			return
+		}
+	}
+
+	// Blobs without an ETag still get one, so clients can revalidate a hit
+	// with If-None-Match.
+	if etag == "" {
+		w.Header().Set("ETag", `"`+contentMd5+`"`)
+	}
+
+	var gzipped *CachedResponseWriter
+	if !varies(w.Header(), "Accept-Encoding") {
+		acceptEncoding = ""
+		gzipped = c.compress(w)
+	}
+
+	size := int64(w.Buffer.Len())
+	if gzipped != nil {
+		size += int64(gzipped.Buffer.Len())
+	}
+	if c.maxBytes > 0 && size > c.maxBytes {
+		c.logger.Debug("response larger than the cache limit, not caching", "path", target.Path, "size", size, "maxBytes", c.maxBytes)
+		return
+	}
+
 	r := &CachedResponse{
-		md5:   contentMd5[0],
-		value: w,
-		checked: time.Now(),
+		method:   method,
+		key:      cacheKey(target, acceptEncoding),
+		md5:      contentMd5,
+		etag:     etag,
+		upstream: upstream,
+		value:    w,
+		gzipped:  gzipped,
+		checked:  time.Now(),
+		size:     size,
+	}
+	if err := c.store.Put(ctx, r); err != nil {
+		c.logger.Error("failed to store cache entry", "path", target.Path, "err", err)
+	}
+}
+
+// matchesContentMd5 reports whether the body of w matches contentMd5, and
+// returns the MD5 of the body as stored. Blob storage computes Content-MD5
+// over the bytes it stores, so for a blob uploaded with a Content-Encoding it
+// covers the encoded bytes, and those are what is cached and served. Upload
+// tools that set Content-MD5 themselves sometimes hash the file before
+// compressing it though, so the decoded body is accepted as well.
+func matchesContentMd5(w *CachedResponseWriter, contentMd5 string) (string, bool) {
+	sum := md5.Sum(w.Buffer.Bytes())
+	bodyMd5 := base64.StdEncoding.EncodeToString(sum[:])
+	if bodyMd5 == contentMd5 {
+		return bodyMd5, true
+	}
+
+	var decoded io.Reader
+	switch strings.ToLower(w.Header().Get("Content-Encoding")) {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(w.Buffer.Bytes()))
+		if err != nil {
+			return bodyMd5, false
+		}
+		decoded = zr
+	case "br":
+		decoded = brotli.NewReader(bytes.NewReader(w.Buffer.Bytes()))
+	default:
+		return bodyMd5, false
+	}
+	hash := md5.New()
+	if _, err := io.Copy(hash, decoded); err != nil {
+		return bodyMd5, false
+	}
+	return bodyMd5, base64.StdEncoding.EncodeToString(hash.Sum(nil)) == contentMd5
+}
+
+// compress returns a gzipped copy of w, or nil if it isn't compressible or
+// compressing wouldn't make it smaller. The copy carries a weak ETag, since
+// its bytes differ from the blob's, and both copies announce that they vary
+// by Accept-Encoding.
+func (c *ResponseCache) compress(w *CachedResponseWriter) *CachedResponseWriter {
+	if c.gzipLevel == 0 || w.Header().Get("Content-Encoding") != "" || !c.compressible.contains(w.Header().Get("Content-Type")) {
+		return nil
+	}
+
+	gzipped := NewCachedResponseWriter()
+	gz, err := gzip.NewWriterLevel(&gzipped.Buffer, c.gzipLevel)
+	if err != nil {
+		c.logger.Error("failed to create gzip writer", "err", err)
+		return nil
+	}
+	if _, err := gz.Write(w.Buffer.Bytes()); err != nil {
+		c.logger.Error("failed to compress cache entry", "err", err)
+		return nil
+	}
+	if err := gz.Close(); err != nil {
+		c.logger.Error("failed to compress cache entry", "err", err)
+		return nil
+	}
+	if gzipped.Buffer.Len() >= w.Buffer.Len() {
+		return nil
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	gzipped.StatusCode = w.StatusCode
+	gzipped.header = w.Header().Clone()
+	gzipped.header.Set("Content-Encoding", "gzip")
+	gzipped.header.Set("Content-Length", strconv.Itoa(gzipped.Buffer.Len()))
+	gzipped.header.Del("Content-Md5")
+	if etag := gzipped.header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		gzipped.header.Set("ETag", "W/"+etag)
+	}
+	return gzipped
+}
+
+// varies reports whether header lists name in Vary.
+func varies(header http.Header, name string) bool {
+	for _, v := range header.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 9110 prescribes for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedHeaders are the headers RFC 9110 has a 304 repeat from the 200
+// it stands in for. The rest describe a body that isn't sent.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+func writeNotModified(res http.ResponseWriter, header http.Header) {
+	for _, name := range notModifiedHeaders {
+		for _, value := range header.Values(name) {
+			res.Header().Add(name, value)
+		}
+	}
+	res.WriteHeader(http.StatusNotModified)
+}
+
+func isUncacheable(header http.Header) bool {
+	for _, v := range header["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-store", "no-cache":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Purge drops every cached response to method for path, whatever its query
+// or accepted encodings, along with responses that a fallback resolved from
+// the blob at path. Paths are full upstream paths, including the container.
+// It returns how many entries were dropped.
+func (c *ResponseCache) Purge(ctx context.Context, method string, path string) (int, error) {
+	return c.store.Purge(ctx, method, path)
+}
+
+// PurgeAll empties the cache and returns how many entries were dropped.
+func (c *ResponseCache) PurgeAll(ctx context.Context) (int, error) {
+	return c.store.PurgeAll(ctx)
+}
+
+// memoryCache keeps entries in process memory, evicting the least recently
+// used beyond maxBytes of bodies or maxEntries entries, where zero is
+// unbounded.
+type memoryCache struct {
+	// mu guards every field below it. Lookups also reorder lru, so there is
+	// no read-only path that could use a shared lock.
+	mu sync.Mutex
+
+	entries    map[string]*CachedResponse
+	maxBytes   int64
+	maxEntries int
+	logger     Logger
+
+	// lru orders entries from most (front) to least (back) recently used.
+	lru  *list.List
+	size int64
+}
+
+func newMemoryCache(maxBytes int64, maxEntries int, logger Logger) *memoryCache {
+	return &memoryCache{
+		entries:    make(map[string]*CachedResponse),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		logger:     logger,
+		lru:        list.New(),
+	}
+}
+
+func (c *memoryCache) Get(ctx context.Context, method string, key string) (*CachedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := c.entries[entryKey(method, key)]
+	if r == nil {
+		return nil, nil
+	}
+	c.lru.MoveToFront(r.element)
+	entry := *r
+	return &entry, nil
+}
+
+func (c *memoryCache) Put(ctx context.Context, r *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old := c.entries[entryKey(r.method, r.key)]; old != nil {
+		c.remove(old)
+	}
+	r.element = c.lru.PushFront(r)
+	c.entries[entryKey(r.method, r.key)] = r
+	c.size += r.size
+
+	c.evict()
+	return nil
+}
+
+func (c *memoryCache) Touch(ctx context.Context, r *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stored := c.stored(r); stored != nil {
+		stored.checked = r.checked
+	}
+	return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, r *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stored := c.stored(r); stored != nil {
+		c.remove(stored)
+	}
+	return nil
+}
+
+func (c *memoryCache) Purge(ctx context.Context, method string, path string) (int, error) {
+	escaped := (&url.URL{Path: path}).EscapedPath()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for _, r := range c.entries {
+		if purgeMatches(r, method, path, escaped) {
+			c.remove(r)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (c *memoryCache) PurgeAll(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := c.lru.Len()
+	c.entries = make(map[string]*CachedResponse)
+	c.lru.Init()
+	c.size = 0
+	return purged, nil
+}
+
+// stored returns the entry r is a copy of, or nil if it has been replaced
+// or evicted since. c.mu must be held.
+func (c *memoryCache) stored(r *CachedResponse) *CachedResponse {
+	stored := c.entries[entryKey(r.method, r.key)]
+	if stored == nil || stored.element != r.element {
+		return nil
+	}
+	return stored
+}
+
+// evict drops least recently used entries until the cache is within its
+// limits. c.mu must be held.
+func (c *memoryCache) evict() {
+	for c.lru.Len() > 0 &&
+		((c.maxBytes > 0 && c.size > c.maxBytes) || (c.maxEntries > 0 && c.lru.Len() > c.maxEntries)) {
+		r := c.lru.Back().Value.(*CachedResponse)
+		c.logger.Debug("evicting cache entry", "method", r.method, "key", r.key)
+		c.remove(r)
+	}
+}
+
+// remove drops r from the cache. c.mu must be held.
+func (c *memoryCache) remove(r *CachedResponse) {
+	c.lru.Remove(r.element)
+	delete(c.entries, entryKey(r.method, r.key))
+	c.size -= r.size
+}
+
+// NoopCache stores nothing. Every request goes to blob storage, but
+// concurrent misses for the same response still share one fetch, which
+// disabling the cache through CacheableMethods doesn't do.
+type NoopCache struct{}
+
+func (NoopCache) Get(ctx context.Context, method string, key string) (*CachedResponse, error) {
+	return nil, nil
+}
+
+func (NoopCache) Put(ctx context.Context, r *CachedResponse) error {
+	return nil
+}
+
+func (NoopCache) Touch(ctx context.Context, r *CachedResponse) error {
+	return nil
+}
+
+func (NoopCache) Delete(ctx context.Context, r *CachedResponse) error {
+	return nil
+}
+
+func (NoopCache) Purge(ctx context.Context, method string, path string) (int, error) {
+	return 0, nil
+}
+
+func (NoopCache) PurgeAll(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// defaultCompressibleTypes mirrors chi's Compress middleware defaults.
+var defaultCompressibleTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"application/javascript",
+	"application/x-javascript",
+	"application/json",
+	"application/atom+xml",
+	"application/rss+xml",
+	"image/svg+xml",
+}
+
+// contentTypeSet matches media types the way chi's Compress middleware does:
+// exactly, or by type for entries like text/*.
+type contentTypeSet struct {
+	types     map[string]bool
+	wildcards map[string]bool
+}
+
+func newContentTypeSet(types []string) contentTypeSet {
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	set := contentTypeSet{types: map[string]bool{}, wildcards: map[string]bool{}}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			set.wildcards[prefix] = true
+		} else {
+			set.types[t] = true
+		}
+	}
+	return set
+}
+
+func (s contentTypeSet) contains(contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.TrimSpace(contentType)
+	if s.types[contentType] {
+		return true
 	}
-	c.cache[method][target.Path] = r
+	mediaType, _, ok := strings.Cut(contentType, "/")
+	return ok && s.wildcards[mediaType]
 }
@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func discardLogger() Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// roundTripFunc lets a function stand in for the transport to blob storage.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func contentMd5Of(body string) string {
+	sum := md5.Sum([]byte(body))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// blobResponse builds the response blob storage sends for body, with its
+// Content-MD5. HEAD requests get the headers alone.
+func blobResponse(req *http.Request, body string) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("Content-Md5", contentMd5Of(body))
+	if req.Method == http.MethodHead {
+		body = ""
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+// bufferedBlob is body as buffered by the middleware in front of the cache.
+func bufferedBlob(body string) *CachedResponseWriter {
+	w := NewCachedResponseWriter()
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Md5", contentMd5Of(body))
+	w.Buffer.WriteString(body)
+	return w
+}
+
+func TestResponseCacheConcurrentAccess(t *testing.T) {
+	const body = "hello"
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return blobResponse(req, body), nil
+	})}
+
+	for _, tc := range []struct {
+		name    string
+		options CacheOptions
+	}{
+		{name: "fresh", options: CacheOptions{EntryLifetime: time.Hour}},
+		{name: "revalidated on every lookup", options: CacheOptions{EntryLifetime: 0}},
+		{name: "revalidated in the background", options: CacheOptions{EntryLifetime: time.Nanosecond, StaleWhileRevalidate: true}},
+		{name: "evicting", options: CacheOptions{EntryLifetime: time.Hour, MaxEntries: 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.Logger = discardLogger()
+			cache := NewMd5ResponseCache(tc.options, client)
+			ctx := context.Background()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 200; i++ {
+				// Half the goroutines share one key, the rest spread over a
+				// few others.
+				target := &url.URL{Scheme: "http", Host: "blob", Path: "/c/same"}
+				if i%2 == 1 {
+					target.Path = fmt.Sprintf("/c/other%d", i%5)
+				}
+				wg.Add(1)
+				go func(i int, target *url.URL) {
+					defer wg.Done()
+					if i%3 == 0 {
+						cache.put(ctx, http.MethodGet, target, target, "", bufferedBlob(body))
+					}
+					if i%50 == 0 {
+						cache.Purge(ctx, http.MethodGet, target.Path)
+					}
+					if w := cache.get(ctx, http.MethodGet, target, "gzip"); w != nil && w.Buffer.String() != body {
+						t.Errorf("got body %q for %s, want %q", w.Buffer.String(), target.Path, body)
+					}
+				}(i, target)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestResponseCacheVerifiesContentMd5(t *testing.T) {
+	cache := NewMd5ResponseCache(CacheOptions{EntryLifetime: time.Hour, Logger: discardLogger()}, http.DefaultClient)
+	ctx := context.Background()
+	intact := &url.URL{Path: "/c/intact.txt"}
+	truncated := &url.URL{Path: "/c/truncated.txt"}
+
+	cache.put(ctx, http.MethodGet, intact, intact, "", bufferedBlob("complete body"))
+	w := bufferedBlob("complete body")
+	w.Buffer.Truncate(5)
+	cache.put(ctx, http.MethodGet, truncated, truncated, "", w)
+
+	if cache.get(ctx, http.MethodGet, intact, "") == nil {
+		t.Error("body matching its Content-MD5 was not cached")
+	}
+	if cache.get(ctx, http.MethodGet, truncated, "") != nil {
+		t.Error("body not matching its Content-MD5 was cached")
+	}
+}
+
+func TestResponseCacheVerifiesGzippedContentMd5(t *testing.T) {
+	const body = "console.log('hello, hello, hello')"
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(body))
+	gz.Close()
+	gzippedBlob := func(contentMd5 string) *CachedResponseWriter {
+		w := NewCachedResponseWriter()
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Md5", contentMd5)
+		w.Buffer.Write(compressed.Bytes())
+		return w
+	}
+
+	cache := NewMd5ResponseCache(CacheOptions{EntryLifetime: time.Hour, Logger: discardLogger()}, http.DefaultClient)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name       string
+		contentMd5 string
+		cached     bool
+	}{
+		{name: "md5 of the stored bytes", contentMd5: contentMd5Of(compressed.String()), cached: true},
+		{name: "md5 of the decoded content", contentMd5: contentMd5Of(body), cached: true},
+		{name: "md5 of neither", contentMd5: contentMd5Of("something else"), cached: false},
+	} {
+		target := &url.URL{Path: "/c/" + tc.name}
+		cache.put(ctx, http.MethodGet, target, target, "", gzippedBlob(tc.contentMd5))
+		w := cache.get(ctx, http.MethodGet, target, "gzip")
+		if (w != nil) != tc.cached {
+			t.Errorf("%s: cached %v, want %v", tc.name, w != nil, tc.cached)
+			continue
+		}
+		// The encoded bytes are what is cached and served.
+		if w != nil && !bytes.Equal(w.Buffer.Bytes(), compressed.Bytes()) {
+			t.Errorf("%s: cached body is not the gzipped blob", tc.name)
+		}
+	}
+}
+
+func TestCachedResponseWriterFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewLimitedResponseWriter(rec, 0)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Write([]byte("data: 1\n\n"))
+	if rec.Flushed || rec.Body.Len() > 0 {
+		t.Fatal("response reached the client before it was flushed")
+	}
+
+	w.Flush()
+	if !rec.Flushed || rec.Body.String() != "data: 1\n\n" || !w.Committed() {
+		t.Fatalf("after Flush client got flushed %v, body %q, committed %v", rec.Flushed, rec.Body.String(), w.Committed())
+	}
+	w.Write([]byte("data: 2\n\n"))
+	if rec.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("after a write following Flush client got %q", rec.Body.String())
+	}
+	if err := w.WriteTo(rec); err != nil || rec.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("WriteTo after Flush = %v and client got %q, want nothing written again", err, rec.Body.String())
+	}
+}
+
+func TestWriteToSetsContentLength(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		want   string
+	}{
+		{name: "stale length", header: map[string]string{"Content-Length": "100"}, want: "4"},
+		{name: "no length", want: "4"},
+		{name: "chunked", header: map[string]string{"Content-Length": "100", "Transfer-Encoding": "chunked"}, want: ""},
+	} {
+		w := NewCachedResponseWriter()
+		for k, v := range tc.header {
+			w.Header().Set(k, v)
+		}
+		w.Write([]byte("body"))
+		rec := httptest.NewRecorder()
+		if err := w.WriteTo(rec); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("Content-Length"); got != tc.want {
+			t.Errorf("%s: Content-Length = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestServedContentLength(t *testing.T) {
+	body := strings.Repeat("body { color: red; }\n", 50)
+	container := newFakeContainer(map[string]string{"/c/app.css": body})
+	server := httptest.NewServer(newTestProxy(t, Config{CacheTTL: time.Hour, CompressionLevel: 5}, container))
+	defer server.Close()
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableCompression: true}}
+
+	// A miss, then hits for the stored body and its compressed copy.
+	for _, encoding := range []string{"", "", "gzip"} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/app.css", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Content-Encoding") != encoding {
+			t.Errorf("Accept-Encoding %q got Content-Encoding %q", encoding, resp.Header.Get("Content-Encoding"))
+		}
+		if resp.ContentLength != int64(len(served)) {
+			t.Errorf("Accept-Encoding %q got Content-Length %d for %d bytes", encoding, resp.ContentLength, len(served))
+		}
+	}
+}
+
+func TestStreamingResponseFlushesIncrementally(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	upstream := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Write([]byte("data: first\n\n"))
+		res.(http.Flusher).Flush()
+		<-release
+		res.Write([]byte("data: last\n\n"))
+	})
+	server := httptest.NewServer(newTestProxy(t, Config{}, upstream))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The upstream is still waiting to send the rest, so the first event
+	// only arrives if every buffering layer flushed it through.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Errorf("first line = %q, %v, want the first event", line, err)
+	}
+}
+
+// discardResponseWriter counts the body it is sent without keeping it, so
+// the only copies of a response are the ones the proxy makes.
+type discardResponseWriter struct {
+	header  http.Header
+	status  int
+	written int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *discardResponseWriter) Write(bytes []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.written += len(bytes)
+	return len(bytes), nil
+}
+
+// A large blob is buffered once, by the innermost layer, and then streamed
+// through every other layer rather than copied into each layer's buffer.
+func TestLargeBlobIsNotCopied(t *testing.T) {
+	const maxBufferBytes = 4 << 20
+	blob := make([]byte, 32<<20)
+	upstream := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/zip")
+		res.Header().Set("x-ms-request-id", "abc")
+		// Like blob storage, send a length, which keeps the reverse proxy
+		// from flushing every write through on its own.
+		res.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		res.Write(blob)
+	})
+	// allocated serves the blob through config's proxy and returns how many
+	// bytes that allocated.
+	allocated := func(config Config) uint64 {
+		t.Helper()
+		proxy := newTestProxy(t, config, upstream)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		w := &discardResponseWriter{header: http.Header{}}
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/site.zip", nil))
+		runtime.ReadMemStats(&after)
+		if w.status != http.StatusOK || w.written != len(blob) {
+			t.Fatalf("client got %d with %d bytes, want 200 with %d bytes", w.status, w.written, len(blob))
+		}
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	single := allocated(Config{MaxBufferBytes: maxBufferBytes, CacheableMethods: []string{}})
+	chain := allocated(Config{
+		MaxBufferBytes:       maxBufferBytes,
+		CacheTTL:             time.Hour,
+		NotFoundPage:         "/404.html",
+		StripHeaderPrefixes:  []string{"x-ms-"},
+		SecurityHeaders:      SecurityHeadersOptions{FrameOptions: "DENY"},
+		DefaultCacheControl:  "public, max-age=3600",
+		HeaderRules:          []HeaderRule{{Glob: "*.zip", Set: map[string]string{"X-Archive": "yes"}}},
+		ForceDownloads:       []string{".zip"},
+		ContentTypeOverrides: map[string]string{".zip": "application/zip"},
+	})
+	// Any layer that copied the buffered body would add at least
+	// maxBufferBytes.
+	if chain > single+maxBufferBytes/2 {
+		t.Errorf("serving a %d byte blob allocated %d bytes through every layer and %d through the fallbacks alone, want within %d",
+			len(blob), chain, single, maxBufferBytes/2)
+	}
+}
+
+func TestCheckUrlMD5(t *testing.T) {
+	target := &url.URL{Scheme: "https", Host: "account.blob.core.windows.net", Path: "/c/app.js"}
+	for _, tc := range []struct {
+		name      string
+		transport roundTripFunc
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "md5 present",
+			transport: func(req *http.Request) (*http.Response, error) {
+				return blobResponse(req, "app"), nil
+			},
+			want: contentMd5Of("app"),
+		},
+		{
+			name: "md5 absent",
+			transport: func(req *http.Request) (*http.Response, error) {
+				resp := blobResponse(req, "app")
+				resp.Header.Del("Content-Md5")
+				return resp, nil
+			},
+			wantErr: true,
+		},
+		{
+			name: "transport error",
+			transport: func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			wantErr: true,
+		},
+		{
+			name: "error status",
+			transport: func(req *http.Request) (*http.Response, error) {
+				resp := blobResponse(req, "The specified blob does not exist.")
+				resp.StatusCode = http.StatusNotFound
+				return resp, nil
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var method string
+			client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				method = req.Method
+				return tc.transport(req)
+			})}
+			got, err := CheckUrlMD5(context.Background(), target, client)
+			if (err != nil) != tc.wantErr || got != tc.want {
+				t.Errorf("CheckUrlMD5 = %q, %v, want %q with error %v", got, err, tc.want, tc.wantErr)
+			}
+			if method != http.MethodHead {
+				t.Errorf("method = %s, want HEAD", method)
+			}
+		})
+	}
+}
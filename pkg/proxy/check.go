@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// CheckResult is the outcome of one connectivity check against blob storage.
+type CheckResult struct {
+	Name   string
+	URL    string
+	Status int
+	Err    error
+}
+
+func (r CheckResult) OK() bool {
+	return r.Err == nil
+}
+
+// Check sends the same HEAD requests a misconfigured deployment would fail
+// on: the container's properties, to see that the account and container
+// exist and the credentials are accepted, and the default env's index
+// document, to see that something has been deployed to it.
+func (scp *StorageContainerProxyHandler) Check() ([]CheckResult, error) {
+	upstream, err := scp.upstreamTransport()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: upstream,
+		Timeout:   scp.UpstreamTimeout,
+	}
+
+	container, _ := containerAndPrefix(scp.Target, scp.UpstreamPathPrefix)
+	container.RawQuery = joinURLQuery(scp.Target, &url.URL{RawQuery: "restype=container"})
+
+	index := *scp.Target
+	index.Path = singleJoiningSlash(index.Path, singleJoiningSlash(scp.DefaultEnv, scp.IndexDocument))
+	index.RawPath = ""
+
+	return []CheckResult{
+		checkUrl("container", container, client, func(status int) error {
+			switch {
+			case status == http.StatusOK:
+				return nil
+			case status == http.StatusUnauthorized || status == http.StatusForbidden:
+				return fmt.Errorf("access denied (%d), check the auth mode and credentials", status)
+			case status == http.StatusNotFound:
+				return fmt.Errorf("container not found (%d), check the account and container names", status)
+			}
+			return fmt.Errorf("blob storage answered %d", status)
+		}),
+		checkUrl("default env", &index, client, func(status int) error {
+			if status != http.StatusOK {
+				return fmt.Errorf("%s not found (%d), is the %q env deployed?", scp.IndexDocument, status, scp.DefaultEnv)
+			}
+			return nil
+		}),
+	}, nil
+}
+
+func checkUrl(name string, target *url.URL, client *http.Client, validate func(status int) error) CheckResult {
+	result := CheckResult{Name: name, URL: target.String()}
+	result.Status, result.Err = CheckUrlExists(target, client)
+	if result.Err == nil {
+		result.Err = validate(result.Status)
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckContainer(t *testing.T) {
+	// The storage account has a container named c, deployed to master.
+	container := newFakeContainer(map[string]string{"/c/master/index.html": "home"})
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("restype") != "container" {
+			container.ServeHTTP(res, req)
+			return
+		}
+		if req.URL.Path != "/c" {
+			res.Header().Set("x-ms-error-code", "ContainerNotFound")
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+	endpoint, _ := url.Parse(upstream.URL)
+
+	for _, tc := range []struct {
+		container string
+		wantOK    bool
+	}{
+		{"c", true},
+		{"missing", false},
+	} {
+		h, err := NewHandler(&Config{
+			AzureStorageContainer: tc.container,
+			BlobEndpoint:          endpoint,
+			DefaultEnv:            "master",
+			Logger:                discardLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := h.Check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Name != "container" || results[0].OK() != tc.wantOK {
+			t.Errorf("container %s: %s check = %d %v, want ok %v",
+				tc.container, results[0].Name, results[0].Status, results[0].Err, tc.wantOK)
+		}
+	}
+}
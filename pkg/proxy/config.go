@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// redacted replaces secrets in Config.Redacted.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of c that is safe to log or serve: the SAS token,
+// basic auth password and hash, admin token and any credentials in URLs are
+// masked, in the host routes too. Logger, AccessLogWriter and
+// ModifyResponse are dropped, since they aren't settings anyone can read
+// back.
+func (c Config) Redacted() Config {
+	if c.SASToken != "" {
+		c.SASToken = redacted
+	}
+	if c.BasicAuth.Password != "" {
+		c.BasicAuth.Password = redacted
+	}
+	if c.BasicAuth.PasswordHash != "" {
+		c.BasicAuth.PasswordHash = redacted
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	if c.CacheRedisURL != "" {
+		c.CacheRedisURL = redactURLString(c.CacheRedisURL)
+	}
+	c.BlobEndpoint = redactURL(c.BlobEndpoint)
+	c.HostRedirectTo = redactURL(c.HostRedirectTo)
+	c.Logger = nil
+	c.AccessLogWriter = nil
+	c.ModifyResponse = nil
+
+	if c.HostRoutes != nil {
+		routes := make(map[string]Config, len(c.HostRoutes))
+		for host, route := range c.HostRoutes {
+			routes[host] = route.Redacted()
+		}
+		c.HostRoutes = routes
+	}
+	return c
+}
+
+// redactURL masks the password and query of u, either of which may hold
+// credentials, returning a copy.
+func redactURL(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+	masked := *u
+	if _, ok := u.User.Password(); ok {
+		masked.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if masked.RawQuery != "" {
+		masked.RawQuery = redacted
+	}
+	return &masked
+}
+
+// redactURLString is redactURL for a URL that hasn't been parsed yet. One
+// that doesn't parse is masked entirely.
+func redactURLString(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	return redactURL(u).String()
+}
+
+// ConfigHandler serves config, which should already be redacted, as JSON.
+func ConfigHandler(config Config) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		writeJSON(res, req, http.StatusOK, config)
+	}
+}
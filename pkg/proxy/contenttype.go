@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// OverrideContentTypes sets the Content-Type of successful responses by the
+// extension of the path served, for blobs uploaded without a content type
+// that blob storage serves as application/octet-stream. Extensions may omit
+// the leading dot.
+func OverrideContentTypes(overrides map[string]string) func(next http.Handler) http.Handler {
+	types := map[string]string{}
+	for ext, contentType := range overrides {
+		for _, normalized := range normalizeExtensions([]string{ext}) {
+			types[normalized] = contentType
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			contentType, ok := types[strings.ToLower(path.Ext(req.URL.Path))]
+			if !ok {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			serveRewritingHeaders(res, req, next, func(status int, header http.Header) {
+				if status < 300 || status == http.StatusNotModified {
+					header.Set("Content-Type", contentType)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOverrideContentTypes(t *testing.T) {
+	handler := OverrideContentTypes(map[string]string{
+		".wasm":       "application/wasm",
+		"webmanifest": "application/manifest+json",
+	})(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/octet-stream")
+		if req.URL.Path == "/missing.wasm" {
+			res.WriteHeader(http.StatusNotFound)
+		}
+		res.Write([]byte("\x00asm"))
+	}))
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{path: "/app.wasm", want: "application/wasm"},
+		{path: "/APP.WASM", want: "application/wasm"},
+		{path: "/site.webmanifest", want: "application/manifest+json"},
+		{path: "/data.bin", want: "application/octet-stream"},
+		{path: "/missing.wasm", want: "application/octet-stream"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got := rec.Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("%s Content-Type = %q, want %q", tc.path, got, tc.want)
+		}
+		if rec.Body.String() != "\x00asm" {
+			t.Errorf("%s body = %q, want it unchanged", tc.path, rec.Body.String())
+		}
+	}
+}
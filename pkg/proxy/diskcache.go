@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCache stores entries as files under a directory, for assets too large
+// to keep many of in memory. Each entry is a .meta file holding its headers,
+// MD5 and revalidation time as JSON, next to a .body file and a .gz file for
+// the compressed copy, all named by a hash of the entry's method and key.
+// Like the memory cache it evicts the least recently used beyond maxBytes of
+// bodies or maxEntries entries, where zero is unbounded.
+type DiskCache struct {
+	dir string
+
+	// mu guards every field below it. File contents are read and written
+	// without it, only renames and removals happen under it, so an entry's
+	// files are never replaced halfway through being read.
+	mu sync.Mutex
+
+	entries    map[string]*diskEntry
+	maxBytes   int64
+	maxEntries int
+	logger     Logger
+
+	// lru orders entries from most (front) to least (back) recently used.
+	lru  *list.List
+	size int64
+	// generation makes the file names of each Put unique, so a Get reading
+	// an entry that is replaced meanwhile finds the files gone rather than
+	// the headers of one response and the body of another.
+	generation uint64
+}
+
+// diskEntry is what DiskCache keeps in memory of an entry on disk.
+type diskEntry struct {
+	method   string
+	key      string
+	upstream *url.URL
+	// name is the path of the entry's files without their extension.
+	name    string
+	gzipped bool
+	size    int64
+	element *list.Element
+}
+
+// diskMeta is the content of a .meta file.
+type diskMeta struct {
+	entryMeta
+	Checked time.Time `json:"checked"`
+}
+
+// NewDiskCache creates dir if needed and indexes the entries already in it,
+// ordered by when each was last stored or revalidated, so the cache survives
+// restarts. Partly written and orphaned files are removed.
+func NewDiskCache(dir string, maxBytes int64, maxEntries int, logger Logger) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:        dir,
+		entries:    make(map[string]*diskEntry),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		logger:     logger,
+		lru:        list.New(),
+		generation: uint64(time.Now().UnixNano()),
+	}
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("loading disk cache: %w", err)
+	}
+	return c, nil
+}
+
+func (c *DiskCache) load() error {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		entry    *diskEntry
+		modified time.Time
+	}
+	var found []loaded
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".meta" {
+			continue
+		}
+		name := filepath.Join(c.dir, strings.TrimSuffix(f.Name(), ".meta"))
+		meta, err := readDiskMeta(name)
+		if err != nil {
+			c.logger.Warn("dropping unreadable disk cache entry", "file", f.Name(), "err", err)
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		r, err := meta.entry(meta.Checked, nil, nil)
+		if err != nil {
+			c.logger.Warn("dropping unreadable disk cache entry", "file", f.Name(), "err", err)
+			continue
+		}
+		found = append(found, loaded{
+			entry: &diskEntry{
+				method:   r.method,
+				key:      r.key,
+				upstream: r.upstream,
+				name:     name,
+				gzipped:  r.gzipped != nil,
+				size:     r.size,
+			},
+			modified: info.ModTime(),
+		})
+	}
+
+	// Oldest first, so pushing each to the front leaves the newest there,
+	// and a later generation of the same entry replaces an earlier one.
+	sort.Slice(found, func(i, j int) bool { return found[i].modified.Before(found[j].modified) })
+	for _, l := range found {
+		if old := c.entries[entryKey(l.entry.method, l.entry.key)]; old != nil {
+			c.remove(old)
+		}
+		c.add(l.entry)
+	}
+	c.evict()
+
+	kept := make(map[string]bool)
+	for _, e := range c.entries {
+		kept[e.name] = true
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name := filepath.Join(c.dir, f.Name())
+		if !kept[strings.TrimSuffix(name, filepath.Ext(name))] {
+			os.Remove(name)
+		}
+	}
+	c.logger.Info("loaded disk cache", "dir", c.dir, "entries", c.lru.Len(), "bytes", c.size)
+	return nil
+}
+
+func (c *DiskCache) Get(ctx context.Context, method string, key string) (*CachedResponse, error) {
+	c.mu.Lock()
+	e := c.entries[entryKey(method, key)]
+	if e == nil {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.lru.MoveToFront(e.element)
+	name, gzipped, element := e.name, e.gzipped, e.element
+	c.mu.Unlock()
+
+	r, err := readDiskEntry(name, gzipped)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Replaced or evicted while reading.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.element = element
+	return r, nil
+}
+
+func readDiskMeta(name string) (*diskMeta, error) {
+	data, err := os.ReadFile(name + ".meta")
+	if err != nil {
+		return nil, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("decoding cache entry: %w", err)
+	}
+	return &meta, nil
+}
+
+func readDiskEntry(name string, gzipped bool) (*CachedResponse, error) {
+	meta, err := readDiskMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(name + ".body")
+	if err != nil {
+		return nil, err
+	}
+	var gz []byte
+	if gzipped {
+		if gz, err = os.ReadFile(name + ".gz"); err != nil {
+			return nil, err
+		}
+	}
+	return meta.entry(meta.Checked, body, gz)
+}
+
+func (c *DiskCache) Put(ctx context.Context, r *CachedResponse) error {
+	meta, err := c.writeTemp(diskMetaFor(r))
+	if err != nil {
+		return err
+	}
+	temps := map[string]string{".meta": meta}
+	defer func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}()
+	if temps[".body"], err = c.writeTemp(r.value.Buffer.Bytes()); err != nil {
+		return err
+	}
+	if r.gzipped != nil {
+		if temps[".gz"], err = c.writeTemp(r.gzipped.Buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	sum := sha256.Sum256([]byte(entryKey(r.method, r.key)))
+	e := &diskEntry{
+		method:   r.method,
+		key:      r.key,
+		upstream: r.upstream,
+		name:     filepath.Join(c.dir, hex.EncodeToString(sum[:])+"-"+strconv.FormatUint(c.generation, 36)),
+		gzipped:  r.gzipped != nil,
+		size:     r.size,
+	}
+	// The meta file goes last, as the one load looks for.
+	for _, ext := range []string{".body", ".gz", ".meta"} {
+		if temps[ext] == "" {
+			continue
+		}
+		if err := os.Rename(temps[ext], e.name+ext); err != nil {
+			removeDiskFiles(e.name)
+			return err
+		}
+		delete(temps, ext)
+	}
+
+	if old := c.entries[entryKey(r.method, r.key)]; old != nil {
+		c.remove(old)
+	}
+	c.add(e)
+	r.element = e.element
+	c.evict()
+	return nil
+}
+
+func diskMetaFor(r *CachedResponse) []byte {
+	data, _ := json.Marshal(diskMeta{entryMeta: newEntryMeta(r), Checked: r.checked})
+	return data
+}
+
+// writeTemp writes data to a new temporary file in the cache directory, on
+// the same filesystem as the files it is renamed to.
+func (c *DiskCache) writeTemp(data []byte) (string, error) {
+	f, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (c *DiskCache) Touch(ctx context.Context, r *CachedResponse) error {
+	temp, err := c.writeTemp(diskMetaFor(r))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stored := c.stored(r); stored != nil {
+		return os.Rename(temp, stored.name+".meta")
+	}
+	return nil
+}
+
+func (c *DiskCache) Delete(ctx context.Context, r *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stored := c.stored(r); stored != nil {
+		c.remove(stored)
+	}
+	return nil
+}
+
+func (c *DiskCache) Purge(ctx context.Context, method string, path string) (int, error) {
+	escaped := (&url.URL{Path: path}).EscapedPath()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for _, e := range c.entries {
+		if purgeMatches(&CachedResponse{method: e.method, key: e.key, upstream: e.upstream}, method, path, escaped) {
+			c.remove(e)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (c *DiskCache) PurgeAll(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := c.lru.Len()
+	for _, e := range c.entries {
+		c.remove(e)
+	}
+	return purged, nil
+}
+
+// stored returns the entry r was read from, or nil if it has been replaced
+// or evicted since. c.mu must be held.
+func (c *DiskCache) stored(r *CachedResponse) *diskEntry {
+	stored := c.entries[entryKey(r.method, r.key)]
+	if stored == nil || stored.element != r.element {
+		return nil
+	}
+	return stored
+}
+
+// add indexes e as the most recently used entry. c.mu must be held.
+func (c *DiskCache) add(e *diskEntry) {
+	e.element = c.lru.PushFront(e)
+	c.entries[entryKey(e.method, e.key)] = e
+	c.size += e.size
+}
+
+// evict drops least recently used entries until the cache is within its
+// limits. c.mu must be held.
+func (c *DiskCache) evict() {
+	for c.lru.Len() > 0 &&
+		((c.maxBytes > 0 && c.size > c.maxBytes) || (c.maxEntries > 0 && c.lru.Len() > c.maxEntries)) {
+		e := c.lru.Back().Value.(*diskEntry)
+		c.logger.Debug("evicting cache entry", "method", e.method, "key", e.key)
+		c.remove(e)
+	}
+}
+
+// remove drops e from the index and deletes its files. c.mu must be held.
+func (c *DiskCache) remove(e *diskEntry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, entryKey(e.method, e.key))
+	c.size -= e.size
+	removeDiskFiles(e.name)
+}
+
+func removeDiskFiles(name string) {
+	for _, ext := range []string{".meta", ".body", ".gz"} {
+		os.Remove(name + ext)
+	}
+}
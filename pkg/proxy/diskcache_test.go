@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDiskResponseCache(t *testing.T, dir string, options CacheOptions, upstream http.RoundTripper) *ResponseCache {
+	t.Helper()
+	store, err := NewDiskCache(dir, options.MaxBytes, options.MaxEntries, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Logger = discardLogger()
+	options.Store = store
+	return NewMd5ResponseCache(options, &http.Client{Transport: upstream})
+}
+
+// diskFileExts lists the extensions of the files in dir, sorted.
+func diskFileExts(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exts []string
+	for _, f := range files {
+		exts = append(exts, filepath.Ext(f.Name()))
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+func TestDiskCacheWriteAndRead(t *testing.T) {
+	dir := t.TempDir()
+	upstream := &etagBlob{body: "large asset"}
+	cache := newDiskResponseCache(t, dir, CacheOptions{EntryLifetime: time.Hour, GzipLevel: 5}, upstream)
+	ctx := context.Background()
+	target := &url.URL{Path: "/c/video.txt"}
+
+	body := strings.Repeat("large asset, ", 100)
+	cache.put(ctx, http.MethodGet, target, target, "", bufferedBlob(body))
+	if got := diskFileExts(t, dir); len(got) != 3 || got[0] != ".body" || got[1] != ".gz" || got[2] != ".meta" {
+		t.Fatalf("cache directory holds %q, want one .body, .gz and .meta file", got)
+	}
+	if w := cache.get(ctx, http.MethodGet, target, ""); w == nil || w.Buffer.String() != body || w.Header().Get("Content-Type") != "text/plain" {
+		t.Fatal("stored entry was not read back")
+	}
+	if w := cache.get(ctx, http.MethodGet, target, "gzip"); w == nil || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("compressed copy was not read back")
+	}
+
+	// The entry survives a restart.
+	restarted := newDiskResponseCache(t, dir, CacheOptions{EntryLifetime: time.Hour}, upstream)
+	if w := restarted.get(ctx, http.MethodGet, target, ""); w == nil || w.Buffer.String() != body {
+		t.Error("entry was lost on restart")
+	}
+}
+
+func TestDiskCacheRevalidation(t *testing.T) {
+	dir := t.TempDir()
+	upstream := &etagBlob{body: "v1"}
+	// With no lifetime every lookup revalidates.
+	cache := newDiskResponseCache(t, dir, CacheOptions{EntryLifetime: 0}, upstream)
+	ctx := context.Background()
+	target := &url.URL{Path: "/c/app.js"}
+
+	cache.put(ctx, http.MethodGet, target, target, "", bufferedBlob("v1"))
+	metas, err := filepath.Glob(filepath.Join(dir, "*.meta"))
+	if err != nil || len(metas) != 1 {
+		t.Fatalf("meta files = %q, %v, want one", metas, err)
+	}
+	name := strings.TrimSuffix(metas[0], ".meta")
+	stored, err := readDiskMeta(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if w := cache.get(ctx, http.MethodGet, target, ""); w == nil || w.Buffer.String() != "v1" {
+		t.Fatal("unchanged blob was not served from the cache")
+	}
+	touched, err := readDiskMeta(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !touched.Checked.After(stored.Checked) {
+		t.Error("revalidating an unchanged blob didn't update when it was checked on disk")
+	}
+
+	upstream.set("v2")
+	if w := cache.get(ctx, http.MethodGet, target, ""); w != nil {
+		t.Errorf("changed blob was served from the cache as %q", w.Buffer.String())
+	}
+	if got := diskFileExts(t, dir); len(got) != 0 {
+		t.Errorf("cache directory holds %q after the blob changed, want nothing", got)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	paths := []string{"/c/a.js", "/c/b.js", "/c/c.js"}
+	for _, tc := range []struct {
+		name    string
+		options CacheOptions
+	}{
+		{name: "max entries", options: CacheOptions{EntryLifetime: time.Hour, MaxEntries: 2}},
+		// Each body is its 7 byte path.
+		{name: "max bytes", options: CacheOptions{EntryLifetime: time.Hour, MaxBytes: 14}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache := newDiskResponseCache(t, dir, tc.options, &etagBlob{})
+			targets := map[string]*url.URL{}
+			for _, p := range paths {
+				targets[p] = &url.URL{Path: p}
+			}
+
+			cache.put(ctx, http.MethodGet, targets["/c/a.js"], targets["/c/a.js"], "", bufferedBlob("/c/a.js"))
+			cache.put(ctx, http.MethodGet, targets["/c/b.js"], targets["/c/b.js"], "", bufferedBlob("/c/b.js"))
+			// Reading a makes b the least recently used.
+			if cache.get(ctx, http.MethodGet, targets["/c/a.js"], "") == nil {
+				t.Fatal("a was not cached")
+			}
+			cache.put(ctx, http.MethodGet, targets["/c/c.js"], targets["/c/c.js"], "", bufferedBlob("/c/c.js"))
+
+			for p, want := range map[string]bool{"/c/a.js": true, "/c/b.js": false, "/c/c.js": true} {
+				if got := cache.get(ctx, http.MethodGet, targets[p], "") != nil; got != want {
+					t.Errorf("%s cached %v, want %v", p, got, want)
+				}
+			}
+			if got := diskFileExts(t, dir); len(got) != 4 {
+				t.Errorf("cache directory holds %q, want the files of two entries", got)
+			}
+
+			// A restart with the same limits keeps the same entries.
+			restarted := newDiskResponseCache(t, dir, tc.options, &etagBlob{})
+			if restarted.get(ctx, http.MethodGet, targets["/c/b.js"], "") != nil {
+				t.Error("evicted entry came back after a restart")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+type explainCandidate struct {
+	Path     string `json:"path"`
+	Upstream string `json:"upstream"`
+	Kind     string `json:"kind,omitempty"`
+}
+
+type explainResponse struct {
+	URL         string             `json:"url"`
+	Host        string             `json:"host"`
+	RoutePrefix string             `json:"routePrefix,omitempty"`
+	Path        string             `json:"path"`
+	Target      string             `json:"target"`
+	Candidates  []explainCandidate `json:"candidates,omitempty"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// ExplainHandler reports how the url query parameter would be resolved: the
+// container it is routed to, the path after rewrite rules and subdomain
+// rewriting and every upstream path the fallbacks would try, in order.
+// Nothing is fetched. A url without a host is explained as if requested on
+// this request's host.
+func (scp *StorageContainerProxyHandler) ExplainHandler() http.HandlerFunc {
+	prefixes := sortedRoutePrefixes(scp.ContainerTargets)
+	// The router has already rejected invalid rules.
+	rewrites, _ := compileRewriteRules(scp.RewriteRules)
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		u, err := url.Parse(req.URL.Query().Get("url"))
+		if err != nil {
+			writeJSON(res, req, http.StatusBadRequest, explainResponse{Error: err.Error()})
+			return
+		}
+		host := u.Host
+		if host == "" {
+			host = req.Host
+		}
+		explain := explainResponse{URL: u.String(), Host: host, Path: u.Path, Target: scp.Target.String()}
+
+		target := scp.Target
+		rewritten, _ := rewritePath(rewrites, u.Path)
+		prefix, path := matchRoutePrefix(prefixes, rewritten)
+		if prefix != "" {
+			target = scp.ContainerTargets[prefix]
+			explain.RoutePrefix = prefix
+			explain.Target = target.String()
+		}
+
+		var envs []string
+		if scp.UseSubdomains {
+			routed := path
+			path, err = subdomainPath(host, routed, scp.BaseDomain, scp.DefaultEnv)
+			if err != nil && scp.HostMismatchAction == HostMismatchDefaultEnv {
+				path, err = "/"+scp.DefaultEnv+routed, nil
+			}
+			if err != nil {
+				explain.Error = err.Error()
+				writeJSON(res, req, http.StatusOK, explain)
+				return
+			}
+		} else {
+			envs = scp.FallbackEnvs
+		}
+		explain.Path = path
+
+		candidates := fallbackCandidates(path, envs, scp.IndexDocument, scp.SPAMode)
+		if matchesAnyGlob(scp.NoFallbackPaths, u.Path) {
+			candidates = []fallbackCandidate{{path: path}}
+		}
+		for _, candidate := range candidates {
+			upstream := *target
+			upstream.Path, upstream.RawPath = joinURLPath(target, &url.URL{Path: candidate.path})
+			upstream.RawQuery = joinURLQuery(target, u)
+			explain.Candidates = append(explain.Candidates, explainCandidate{
+				Path:     candidate.path,
+				Upstream: upstream.String(),
+				Kind:     candidate.kind,
+			})
+		}
+		writeJSON(res, req, http.StatusOK, explain)
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TrustedProxies is a set of networks whose X-Forwarded-* headers are
+// believed. Requests from any other peer are taken at face value.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies accepts CIDRs and bare IP addresses.
+func ParseTrustedProxies(entries []string) (TrustedProxies, error) {
+	networks, err := parseNetworks(entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return networks, nil
+}
+
+// parseNetworks parses CIDRs and bare IP addresses, the latter as a network
+// of just that address.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// networksContain reports whether addr, an IP with or without a port, is in
+// any of networks.
+func networksContain(networks []*net.IPNet, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(strings.TrimSpace(host))
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Trusts reports whether addr, an IP with or without a port, belongs to a
+// trusted proxy.
+func (t TrustedProxies) Trusts(addr string) bool {
+	return networksContain(t, addr)
+}
+
+// firstHeaderValue returns the first entry of a comma-separated header.
+func firstHeaderValue(req *http.Request, name string) string {
+	return strings.TrimSpace(strings.Split(req.Header.Get(name), ",")[0])
+}
+
+// clientAddr picks the client out of X-Forwarded-For: the rightmost address
+// that isn't itself a trusted proxy, since everything to its left could have
+// been sent by the client.
+func (t TrustedProxies) clientAddr(forwardedFor string) string {
+	addrs := strings.Split(forwardedFor, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if !t.Trusts(addr) {
+			return addr
+		}
+	}
+	return strings.TrimSpace(addrs[0])
+}
+
+type schemeContextKey struct{}
+
+// ForwardedHeaders applies X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-For to requests from a trusted proxy, so the rest of the chain
+// sees the client-facing scheme, host and address. Headers from any other
+// peer are ignored.
+func ForwardedHeaders(trusted TrustedProxies) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			scheme := "http"
+			if req.TLS != nil {
+				scheme = "https"
+			}
+
+			if trusted.Trusts(req.RemoteAddr) {
+				if proto := firstHeaderValue(req, "X-Forwarded-Proto"); proto != "" {
+					scheme = strings.ToLower(proto)
+				}
+				if host := firstHeaderValue(req, "X-Forwarded-Host"); host != "" {
+					req.Host = host
+				}
+				if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+					req.RemoteAddr = trusted.clientAddr(forwardedFor)
+				}
+			}
+
+			ctx := context.WithValue(req.Context(), schemeContextKey{}, scheme)
+			next.ServeHTTP(res, req.WithContext(ctx))
+		})
+	}
+}
+
+// RequestScheme returns the scheme the client used, as resolved by
+// ForwardedHeaders, falling back to whether the connection itself is TLS.
+func RequestScheme(req *http.Request) string {
+	if scheme, ok := req.Context().Value(schemeContextKey{}).(string); ok {
+		return scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RedirectToHTTPS sends clients that connected over plain HTTP a 301 to the
+// same host and path over HTTPS on port, or the default port when port is 0
+// or 443.
+func RedirectToHTTPS(port int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if RequestScheme(req) != "http" {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+				if strings.Contains(host, ":") {
+					host = "[" + host + "]"
+				}
+			}
+			if port != 0 && port != 443 {
+				host += ":" + strconv.Itoa(port)
+			}
+			http.Redirect(res, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+		})
+	}
+}
@@ -1,19 +1,29 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type Config struct {
@@ -22,6 +32,257 @@ type Config struct {
 	BaseDomain            string
 	DefaultEnv            string
 	UseSubdomains         bool
+	Port                  int
+	ShutdownGracePeriod   time.Duration
+	InsecureSkipVerify    bool
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	// CacheTTL is how long a cached entry is served before its MD5 is
+	// revalidated. Zero always revalidates, negative never does.
+	CacheTTL        time.Duration
+	CacheMaxBytes   int64
+	CacheMaxEntries int
+	// CacheErrorBackoff is how long a stale entry keeps being served without
+	// another attempt after revalidating it fails, so an unreachable backend
+	// isn't asked again on every request. Defaults to 5s.
+	CacheErrorBackoff time.Duration
+	// StaleWhileRevalidate serves an expired entry immediately and
+	// revalidates it in the background, instead of holding up the request
+	// until blob storage confirms it is still current.
+	StaleWhileRevalidate bool
+	// CacheableStatusCodes defaults to 200 only.
+	CacheableStatusCodes []int
+	// CacheableMethods defaults to GET when nil, and an empty list disables
+	// the cache. HEAD responses are cached without a body.
+	CacheableMethods []string
+	NotFoundPage     string
+	// CacheBackend defaults to CacheBackendMemory. CacheBackendRedis stores
+	// entries at CacheRedisURL, e.g. redis://host:6379/0, for CacheRedisTTL
+	// after they were last revalidated, 24 hours by default. CacheMaxBytes
+	// then only limits single responses and CacheMaxEntries is unused.
+	// CacheBackendNone stores nothing. CacheBackendDisk stores entries as
+	// files under CacheDir, which host routes each get a subdirectory of,
+	// within CacheMaxBytes and CacheMaxEntries.
+	CacheBackend  CacheBackend
+	CacheRedisURL string
+	CacheRedisTTL time.Duration
+	CacheDir      string
+	// FallbackEnvs are tried in order when a path 404s without subdomains.
+	// Defaults to DefaultEnv alone. Within the path and each env, a missing
+	// extensionless /x is tried as /x.html before /x/<index>, so x.html wins
+	// when both exist, and then as the index document next to it.
+	FallbackEnvs []string
+	// MaxFallbacks caps the fallback paths tried for one client request,
+	// including those tried for the NotFoundPage, after which the last 404
+	// is served. Zero tries every candidate.
+	MaxFallbacks int
+	Metrics      bool
+	// Tracing records OpenTelemetry spans for requests and the requests they
+	// make to blob storage, using the globally registered tracer provider,
+	// and passes the trace on to blob storage in a traceparent header.
+	Tracing bool
+	// SPAMode serves the env's index document, with a 200, for extensionless
+	// paths that 404 after every other fallback, so a single-page app can
+	// route them on the client.
+	SPAMode bool
+	// RedirectTrailingSlash answers a 301 to path/ when path 404s but
+	// path/<index> exists, instead of serving the index document at path,
+	// so relative links on the page resolve against the directory.
+	RedirectTrailingSlash bool
+	// TrailingSlashPolicy redirects extensionless paths to one canonical
+	// form, with or without a trailing slash, before the fallbacks. It
+	// defaults to TrailingSlashNone.
+	TrailingSlashPolicy TrailingSlashPolicy
+	// CanonicalizeIndex redirects requests for path/<index> to path/.
+	CanonicalizeIndex bool
+	// DirectoryListing serves an HTML listing of the blobs under a path
+	// ending in / when it 404s after every fallback. It needs list
+	// permission on the container and is ignored with LocalDir.
+	DirectoryListing bool
+	// DirectoryListingLimit caps the entries in a directory listing and
+	// defaults to 10000.
+	DirectoryListingLimit int
+	// NoFallbackPaths are globs, matched like HeaderRule globs, for paths
+	// that are proxied as-is and answer blob storage's 404 when missing.
+	NoFallbackPaths []string
+	// Logger defaults to slog.Default() when nil.
+	Logger Logger
+	// RedirectExtensions are redirected straight to blob storage. Entries may
+	// omit the leading dot, and an empty list disables the redirect.
+	RedirectExtensions []string
+	// RedirectMode defaults to RedirectModeRedirect.
+	RedirectMode RedirectMode
+	// ForceDownloads are extensions served with Content-Disposition:
+	// attachment, named after the requested path. Entries may omit the
+	// leading dot. They are proxied even if RedirectExtensions lists them,
+	// since a redirect to blob storage can't carry the header.
+	ForceDownloads []string
+	// HostMismatchAction decides how UseSubdomains answers a host that
+	// doesn't map to an env under BaseDomain, and defaults to
+	// HostMismatchError. HostMismatchRedirect sends the client to the same
+	// path under HostRedirectTo.
+	HostMismatchAction HostMismatchAction
+	HostRedirectTo     *url.URL
+	// CORSAllowedOrigins defaults to localhost, the base domain and its
+	// subdomains. CORSAllowedMethods and CORSAllowedHeaders default to the
+	// cors package defaults, and "*" allows any header. CORSExposedHeaders
+	// lists response headers scripts may read, such as ETag.
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSExposedHeaders   []string
+	CORSAllowCredentials bool
+	// CompressionLevel is the gzip level (0-9) and a negative value disables
+	// compression. CompressibleTypes defaults to chi's list when empty.
+	CompressionLevel  int
+	CompressibleTypes []string
+	// SASToken authenticates requests to a private container. It is never
+	// forwarded to clients.
+	SASToken string
+	// AuthMode defaults to AuthModeSAS when SASToken is set and AuthModeNone
+	// otherwise. ManagedIdentityID selects a user-assigned identity.
+	AuthMode          AuthMode
+	ManagedIdentityID string
+	// EndpointSuffix is appended to the account name to form the blob host,
+	// defaulting to blob.core.windows.net. BlobEndpoint overrides the whole
+	// account URL instead, e.g. http://127.0.0.1:10000/devstoreaccount1 for
+	// Azurite. Without AzureStorageContainer, BlobEndpoint is the URL of the
+	// container itself, e.g. http://127.0.0.1:10000/devstoreaccount1/web.
+	EndpointSuffix string
+	BlobEndpoint   *url.URL
+	// UpstreamPathPrefix is a folder in every container that paths are
+	// resolved under, e.g. dist to serve /app.js from dist/app.js.
+	UpstreamPathPrefix string
+	// UpstreamTimeout bounds every request to blob storage and defaults to
+	// 30 seconds.
+	UpstreamTimeout time.Duration
+	// StripHeaderPrefixes removes matching upstream response headers before
+	// they reach clients. Nil defaults to x-ms-, an empty slice strips nothing.
+	StripHeaderPrefixes []string
+	SecurityHeaders     SecurityHeadersOptions
+	// ForceHtmlContentType serves pages resolved via the .html fallback as
+	// text/html even if the blob's content type metadata says otherwise.
+	ForceHtmlContentType bool
+	// ContentTypeOverrides maps file extensions to the content type that
+	// successful responses for them are served with, e.g. .wasm to
+	// application/wasm.
+	ContentTypeOverrides map[string]string
+	// MaxBufferBytes bounds how much of a response is held in memory for the
+	// fallback and cache middleware. Zero buffers whole responses.
+	MaxBufferBytes int64
+	// ContainerRoutes maps path prefixes to other containers in the same
+	// account. The prefix is stripped before the path reaches the container,
+	// and unmatched paths go to AzureStorageContainer.
+	ContainerRoutes map[string]string
+	// HostRoutes serves each hostname from its own account and container.
+	// When set, requests for any other host get a 404. A route without a
+	// Logger uses this config's.
+	HostRoutes map[string]Config
+	// Debug serves /_scproxy/explain, which shows how a URL would be resolved,
+	// and /_scproxy/config, which shows this config with secrets redacted.
+	Debug bool
+	// HTTPSRedirect sends plain HTTP clients to HTTPS.
+	HTTPSRedirect bool
+	// TLSCertFile and TLSKeyFile serve HTTPS on Port. Alternatively AutoTLS
+	// obtains certificates for BaseDomain, its subdomains and the host routes
+	// from Let's Encrypt, kept in AutoTLSCacheDir. A subdomain gets its
+	// certificate on its first request, whatever label the client made up,
+	// so with many or untrusted envs serve a wildcard certificate from
+	// TLSCertFile instead. HTTPPort additionally serves plain HTTP, for
+	// HTTPSRedirect and ACME challenges.
+	TLSCertFile     string
+	TLSKeyFile      string
+	AutoTLS         bool
+	AutoTLSCacheDir string
+	HTTPPort        int
+	// ListenAddr is the host or IP address that Port and HTTPPort are bound
+	// on. Empty listens on every interface.
+	ListenAddr string
+	// UnixSocket serves on a Unix domain socket at this path instead of
+	// Port. The socket is removed on shutdown.
+	UnixSocket string
+	// H2C serves HTTP/2 over plain connections to clients that ask for it,
+	// such as a load balancer or sidecar speaking h2c. HTTPS negotiates
+	// HTTP/2 regardless.
+	H2C bool
+	// TrustedProxies lists the CIDRs or IP addresses whose X-Forwarded-Proto,
+	// X-Forwarded-Host and X-Forwarded-For headers are believed. Host routes
+	// use this config's list.
+	TrustedProxies []string
+	// NegativeCacheTTL is how long a path that 404'd after every fallback is
+	// answered from memory, zero disables it. NegativeCacheEntries caps how
+	// many such paths are kept and defaults to 10000.
+	NegativeCacheTTL     time.Duration
+	NegativeCacheEntries int
+	// AccessLog is the access log format, clf or json, and empty disables it.
+	// Lines go to AccessLogWriter, which defaults to stdout.
+	AccessLog       string
+	AccessLogWriter io.Writer
+	// StatsEndpoint serves the counters from Stats at /_scproxy/stats.
+	StatsEndpoint bool
+	// IndexDocument is the file served for directory paths and defaults to
+	// index.html.
+	IndexDocument string
+	// ServePrecompressed serves a file's .br or .gz sibling when the client
+	// accepts that encoding.
+	ServePrecompressed bool
+	// HeaderRules set and remove response headers by request path, e.g. to
+	// mark fingerprinted assets immutable.
+	HeaderRules []HeaderRule
+	// BasicAuth applies to /metrics, /_scproxy/stats and the Debug routes
+	// like any other path. /readyz is left open for probes and the admin
+	// routes are authenticated by AdminToken instead.
+	BasicAuth BasicAuthOptions
+	// RobotsTxt is served as /robots.txt, and Favicon answers /favicon.ico,
+	// without asking blob storage. Like the health routes, they bypass the
+	// fallbacks and every other middleware, basic auth included.
+	RobotsTxt string
+	Favicon   FaviconOptions
+	// AllowedMethods are the request methods proxied, others get a 405. Nil
+	// defaults to GET, HEAD and OPTIONS, an empty slice allows any method.
+	AllowedMethods []string
+	// DefaultCacheControl is sent with successful responses that have no
+	// Cache-Control of their own, after HeaderRules. HTML pages get
+	// HTMLCacheControl instead when it is set.
+	DefaultCacheControl string
+	HTMLCacheControl    string
+	// RewriteRules rewrite request paths before they are cached or resolved.
+	// Header rules and NoFallbackPaths match the path before rewriting.
+	RewriteRules []RewriteRule
+	// AllowCIDRs and DenyCIDRs restrict which client addresses are served.
+	// An empty allow list admits every address that isn't denied. Only
+	// /healthz answers any client, so liveness probes keep working.
+	AllowCIDRs []string
+	DenyCIDRs  []string
+	// RateLimitRPS limits requests per second from each client IP, with
+	// bursts of up to RateLimitBurst, on every path but /healthz. Zero
+	// disables the limit.
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// MaxRetries retries GET and HEAD requests to blob storage that fail with
+	// a connection error or 5xx, up to 5 times, within UpstreamTimeout.
+	// RetryBackoff is the base of the jittered exponential backoff and
+	// defaults to 100ms.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// AdminToken enables the /_scproxy admin endpoints for requests carrying
+	// it as a bearer token: POST /_scproxy/purge drops given paths from the
+	// cache and POST /_scproxy/invalidate empties it, meant to be called on
+	// deploy. Either way entries are still revalidated once CacheTTL passes,
+	// so a deploy pipeline that always invalidates can set a negative
+	// CacheTTL to never revalidate.
+	AdminToken string
+	// LocalDir serves files from a local directory instead of blob storage,
+	// for developing without access to Azure. The directory is laid out like
+	// the container.
+	LocalDir string
+	// ModifyResponse post-processes every response from blob storage, such
+	// as injecting a snippet into HTML or with RewriteHrefOrigins. It runs
+	// before the fallback, cache and other buffering middleware see the
+	// response, so what it returns is what gets cached. An error answers
+	// 502. It isn't called for LocalDir.
+	ModifyResponse func(*http.Response) error `json:"-"`
 }
 
 type StorageContainerProxyHandler struct {
@@ -30,139 +291,1257 @@ type StorageContainerProxyHandler struct {
 	BaseDomain            string
 	DefaultEnv            string
 	UseSubdomains         bool
+	Port                  int
+	ShutdownGracePeriod   time.Duration
+	InsecureSkipVerify    bool
+	CacheTTL              time.Duration
+	CacheMaxBytes         int64
+	CacheMaxEntries       int
+	CacheBackend          CacheBackend
+	CacheRedisURL         string
+	CacheRedisTTL         time.Duration
+	CacheDir              string
+	CacheErrorBackoff     time.Duration
+	StaleWhileRevalidate  bool
+	CacheableStatusCodes  []int
+	CacheableMethods      []string
+	NotFoundPage          string
+	FallbackEnvs          []string
+	MaxFallbacks          int
+	SPAMode               bool
+	RedirectTrailingSlash bool
+	TrailingSlashPolicy   TrailingSlashPolicy
+	CanonicalizeIndex     bool
+	DirectoryListing      bool
+	DirectoryListingLimit int
+	UpstreamPathPrefix    string
+	NoFallbackPaths       []string
+	Metrics               bool
+	Tracing               bool
+	Logger                Logger
+	RedirectExtensions    []string
+	RedirectMode          RedirectMode
+	ForceDownloads        []string
+	HostMismatchAction    HostMismatchAction
+	HostRedirectTo        *url.URL
+	CORSAllowedOrigins    []string
+	CORSAllowedMethods    []string
+	CORSAllowedHeaders    []string
+	CORSExposedHeaders    []string
+	CORSAllowCredentials  bool
+	CompressionLevel      int
+	CompressibleTypes     []string
+	SASToken              string
+	AuthMode              AuthMode
+	ManagedIdentityID     string
+	UpstreamTimeout       time.Duration
+	StripHeaderPrefixes   []string
+	SecurityHeaders       SecurityHeadersOptions
+	ForceHtmlContentType  bool
+	ContentTypeOverrides  map[string]string
+	MaxBufferBytes        int64
 	Target                *url.URL
+	ContainerTargets      map[string]*url.URL
+	HostRoutes            map[string]*StorageContainerProxyHandler
+	Debug                 bool
+	HTTPSRedirect         bool
+	TLSCertFile           string
+	TLSKeyFile            string
+	AutoTLS               bool
+	AutoTLSCacheDir       string
+	HTTPPort              int
+	ListenAddr            string
+	UnixSocket            string
+	H2C                   bool
+	TrustedProxies        []string
+	NegativeCacheTTL      time.Duration
+	NegativeCacheEntries  int
+	AccessLog             string
+	AccessLogWriter       io.Writer
+	StatsEndpoint         bool
+	IndexDocument         string
+	ServePrecompressed    bool
+	HeaderRules           []HeaderRule
+	DefaultCacheControl   string
+	HTMLCacheControl      string
+	RewriteRules          []RewriteRule
+	AllowedMethods        []string
+	BasicAuth             BasicAuthOptions
+	RobotsTxt             string
+	Favicon               FaviconOptions
+	AllowCIDRs            []string
+	DenyCIDRs             []string
+	RateLimitRPS          float64
+	RateLimitBurst        int
+	MaxRetries            int
+	RetryBackoff          time.Duration
+	AdminToken            string
+	LocalDir              string
+	Transport             *http.Transport
+	ModifyResponse        func(*http.Response) error
+
+	// config is the redacted config the handler was built from, for
+	// /_scproxy/config.
+	config Config
 }
 
-func NewHandler(config *Config) StorageContainerProxyHandler {
-	return StorageContainerProxyHandler{
+const (
+	defaultPort                = 3000
+	defaultShutdownGracePeriod = 30 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultEndpointSuffix      = "blob.core.windows.net"
+	defaultUpstreamTimeout     = 30 * time.Second
+	defaultIndexDocument       = "index.html"
+	defaultRetryBackoff        = 100 * time.Millisecond
+	defaultAutoTLSCacheDir     = "autocert"
+	defaultCacheErrorBackoff   = 5 * time.Second
+	defaultListingLimit        = 10000
+	defaultCacheRedisTTL       = 24 * time.Hour
+)
+
+// NewHandler applies defaults to config and returns the handler, or an error
+// describing the first required setting that is missing.
+func NewHandler(config *Config) (*StorageContainerProxyHandler, error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	fallbackEnvs := config.FallbackEnvs
+	if len(fallbackEnvs) == 0 {
+		fallbackEnvs = []string{config.DefaultEnv}
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	redirectMode := config.RedirectMode
+	if redirectMode == "" {
+		redirectMode = RedirectModeRedirect
+	}
+	authMode := config.AuthMode
+	if authMode == "" {
+		authMode = AuthModeNone
+		if config.SASToken != "" {
+			authMode = AuthModeSAS
+		}
+	}
+	stripHeaderPrefixes := config.StripHeaderPrefixes
+	if stripHeaderPrefixes == nil {
+		stripHeaderPrefixes = []string{"x-ms-"}
+	}
+	indexDocument := strings.Trim(config.IndexDocument, "/")
+	if indexDocument == "" {
+		indexDocument = defaultIndexDocument
+	}
+	basicAuth := config.BasicAuth
+	if basicAuth.Realm == "" {
+		basicAuth.Realm = config.BaseDomain
+	}
+	autoTLSCacheDir := config.AutoTLSCacheDir
+	if autoTLSCacheDir == "" {
+		autoTLSCacheDir = defaultAutoTLSCacheDir
+	}
+	cacheErrorBackoff := config.CacheErrorBackoff
+	if cacheErrorBackoff == 0 {
+		cacheErrorBackoff = defaultCacheErrorBackoff
+	}
+	trailingSlashPolicy := config.TrailingSlashPolicy
+	if trailingSlashPolicy == "" {
+		trailingSlashPolicy = TrailingSlashNone
+	}
+	hostMismatchAction := config.HostMismatchAction
+	if hostMismatchAction == "" {
+		hostMismatchAction = HostMismatchError
+	}
+	cacheBackend := config.CacheBackend
+	if cacheBackend == "" {
+		cacheBackend = CacheBackendMemory
+	}
+	cacheRedisTTL := config.CacheRedisTTL
+	if cacheRedisTTL == 0 {
+		cacheRedisTTL = defaultCacheRedisTTL
+	}
+	listingLimit := config.DirectoryListingLimit
+	if listingLimit == 0 {
+		listingLimit = defaultListingLimit
+	}
+	htmlCacheControl := config.HTMLCacheControl
+	if htmlCacheControl == "" {
+		htmlCacheControl = config.DefaultCacheControl
+	}
+	allowedMethods := config.AllowedMethods
+	if allowedMethods == nil {
+		allowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	cacheableMethods := config.CacheableMethods
+	if cacheableMethods == nil {
+		cacheableMethods = []string{http.MethodGet}
+	}
+	retryBackoff := config.RetryBackoff
+	if retryBackoff == 0 {
+		retryBackoff = defaultRetryBackoff
+	}
+	accessLogWriter := config.AccessLogWriter
+	if accessLogWriter == nil {
+		accessLogWriter = os.Stdout
+	}
+	shutdownGracePeriod := config.ShutdownGracePeriod
+	if shutdownGracePeriod == 0 {
+		shutdownGracePeriod = defaultShutdownGracePeriod
+	}
+
+	h := &StorageContainerProxyHandler{
 		AzureStorageAccount:   config.AzureStorageAccount,
 		AzureStorageContainer: config.AzureStorageContainer,
 		BaseDomain:            config.BaseDomain,
 		DefaultEnv:            config.DefaultEnv,
 		UseSubdomains:         config.UseSubdomains,
-		Target: &url.URL{
+		Port:                  port,
+		ShutdownGracePeriod:   shutdownGracePeriod,
+		InsecureSkipVerify:    config.InsecureSkipVerify,
+		CacheTTL:              config.CacheTTL,
+		CacheMaxBytes:         config.CacheMaxBytes,
+		CacheMaxEntries:       config.CacheMaxEntries,
+		CacheBackend:          cacheBackend,
+		CacheRedisURL:         config.CacheRedisURL,
+		CacheRedisTTL:         cacheRedisTTL,
+		CacheDir:              config.CacheDir,
+		CacheErrorBackoff:     cacheErrorBackoff,
+		StaleWhileRevalidate:  config.StaleWhileRevalidate,
+		CacheableStatusCodes:  config.CacheableStatusCodes,
+		CacheableMethods:      cacheableMethods,
+		NotFoundPage:          config.NotFoundPage,
+		FallbackEnvs:          fallbackEnvs,
+		MaxFallbacks:          config.MaxFallbacks,
+		SPAMode:               config.SPAMode,
+		RedirectTrailingSlash: config.RedirectTrailingSlash,
+		TrailingSlashPolicy:   trailingSlashPolicy,
+		CanonicalizeIndex:     config.CanonicalizeIndex,
+		DirectoryListing:      config.DirectoryListing,
+		DirectoryListingLimit: listingLimit,
+		UpstreamPathPrefix:    config.UpstreamPathPrefix,
+		NoFallbackPaths:       config.NoFallbackPaths,
+		Metrics:               config.Metrics,
+		Tracing:               config.Tracing,
+		Logger:                logger,
+		RedirectExtensions:    normalizeExtensions(config.RedirectExtensions),
+		RedirectMode:          redirectMode,
+		ForceDownloads:        normalizeExtensions(config.ForceDownloads),
+		HostMismatchAction:    hostMismatchAction,
+		HostRedirectTo:        config.HostRedirectTo,
+		CORSAllowedOrigins:    config.CORSAllowedOrigins,
+		CORSAllowedMethods:    config.CORSAllowedMethods,
+		CORSAllowedHeaders:    config.CORSAllowedHeaders,
+		CORSExposedHeaders:    config.CORSExposedHeaders,
+		CORSAllowCredentials:  config.CORSAllowCredentials,
+		CompressionLevel:      config.CompressionLevel,
+		CompressibleTypes:     config.CompressibleTypes,
+		SASToken:              config.SASToken,
+		AuthMode:              authMode,
+		ManagedIdentityID:     config.ManagedIdentityID,
+		UpstreamTimeout:       upstreamTimeout(config),
+		StripHeaderPrefixes:   stripHeaderPrefixes,
+		SecurityHeaders:       config.SecurityHeaders,
+		ForceHtmlContentType:  config.ForceHtmlContentType,
+		ContentTypeOverrides:  config.ContentTypeOverrides,
+		MaxBufferBytes:        config.MaxBufferBytes,
+		Debug:                 config.Debug,
+		HTTPSRedirect:         config.HTTPSRedirect,
+		TLSCertFile:           config.TLSCertFile,
+		TLSKeyFile:            config.TLSKeyFile,
+		AutoTLS:               config.AutoTLS,
+		AutoTLSCacheDir:       autoTLSCacheDir,
+		HTTPPort:              config.HTTPPort,
+		ListenAddr:            config.ListenAddr,
+		UnixSocket:            config.UnixSocket,
+		H2C:                   config.H2C,
+		TrustedProxies:        config.TrustedProxies,
+		NegativeCacheTTL:      config.NegativeCacheTTL,
+		NegativeCacheEntries:  config.NegativeCacheEntries,
+		AccessLog:             config.AccessLog,
+		AccessLogWriter:       accessLogWriter,
+		StatsEndpoint:         config.StatsEndpoint,
+		IndexDocument:         indexDocument,
+		ServePrecompressed:    config.ServePrecompressed,
+		HeaderRules:           config.HeaderRules,
+		DefaultCacheControl:   config.DefaultCacheControl,
+		HTMLCacheControl:      htmlCacheControl,
+		RewriteRules:          config.RewriteRules,
+		AllowedMethods:        allowedMethods,
+		BasicAuth:             basicAuth,
+		RobotsTxt:             config.RobotsTxt,
+		Favicon:               config.Favicon,
+		AllowCIDRs:            config.AllowCIDRs,
+		DenyCIDRs:             config.DenyCIDRs,
+		RateLimitRPS:          config.RateLimitRPS,
+		RateLimitBurst:        config.RateLimitBurst,
+		MaxRetries:            config.MaxRetries,
+		RetryBackoff:          retryBackoff,
+		AdminToken:            config.AdminToken,
+		LocalDir:              config.LocalDir,
+		Transport:             newTransport(config),
+		ModifyResponse:        config.ModifyResponse,
+		Target:                newTarget(config, config.AzureStorageContainer),
+	}
+	if len(config.ContainerRoutes) > 0 {
+		h.ContainerTargets = map[string]*url.URL{}
+		for prefix, container := range config.ContainerRoutes {
+			h.ContainerTargets[normalizeRoutePrefix(prefix)] = newTarget(config, container)
+		}
+	}
+	if len(config.HostRoutes) > 0 {
+		h.HostRoutes = map[string]*StorageContainerProxyHandler{}
+		for host, hostConfig := range config.HostRoutes {
+			if hostConfig.Logger == nil {
+				hostConfig.Logger = logger
+			}
+			// Two disk caches in one directory would delete each
+			// other's files as orphans.
+			if hostConfig.CacheDir != "" && hostConfig.CacheDir == config.CacheDir {
+				hostConfig.CacheDir = filepath.Join(config.CacheDir, strings.ToLower(host))
+			}
+			hostHandler, err := NewHandler(&hostConfig)
+			if err != nil {
+				return nil, fmt.Errorf("host route %s: %w", host, err)
+			}
+			h.HostRoutes[strings.ToLower(host)] = hostHandler
+		}
+	}
+	if len(h.CORSAllowedOrigins) == 0 {
+		h.CORSAllowedOrigins = []string{
+			"http://localhost",
+			"http://localhost:*",
+			"http://127.0.0.1",
+			fmt.Sprintf("https://%s", h.BaseDomain),
+			fmt.Sprintf("https://*.%s", h.BaseDomain),
+			fmt.Sprintf("%s://%s", h.Target.Scheme, h.Target.Host),
+		}
+	}
+	h.config = config.Redacted()
+
+	return h, nil
+}
+
+// validateConfig checks the settings NewHandler has no default for. Serving
+// a local directory needs neither an account nor a container, and a custom
+// blob endpoint already names the account.
+func validateConfig(config *Config) error {
+	// Report every missing setting at once rather than one per attempt.
+	var missing []string
+	if config.LocalDir == "" {
+		if config.AzureStorageAccount == "" && config.BlobEndpoint == nil {
+			missing = append(missing, "a storage account or blob endpoint")
+		}
+		if config.AzureStorageContainer == "" && config.BlobEndpoint == nil {
+			missing = append(missing, "a storage container")
+		}
+	}
+	if config.UseSubdomains && config.BaseDomain == "" {
+		missing = append(missing, "a base domain when using subdomains")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+	}
+	if config.CacheBackend == CacheBackendRedis && config.CacheRedisURL == "" {
+		return errors.New("a Redis URL is required for the redis cache backend")
+	}
+	if config.CacheBackend == CacheBackendDisk && config.CacheDir == "" {
+		return errors.New("a cache directory is required for the disk cache backend")
+	}
+	if config.HostMismatchAction == HostMismatchRedirect && (config.HostRedirectTo == nil || config.HostRedirectTo.Host == "") {
+		return errors.New("an absolute redirect URL is required to redirect mismatched hosts")
+	}
+	if config.ListenAddr != "" && net.ParseIP(config.ListenAddr) == nil && !validHostname(config.ListenAddr) {
+		return fmt.Errorf("listen address %q is not an IP address or hostname", config.ListenAddr)
+	}
+	return nil
+}
+
+// validHostname reports whether host consists of dot-separated labels of
+// letters, digits and hyphens.
+func validHostname(host string) bool {
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// newTarget returns the URL of container in the configured storage account,
+// under UpstreamPathPrefix if one is set.
+func newTarget(config *Config, container string) *url.URL {
+	var target url.URL
+	if config.BlobEndpoint != nil {
+		target = *config.BlobEndpoint
+		if container != "" {
+			target.Path = singleJoiningSlash(target.Path, container)
+		}
+		target.RawPath = ""
+	} else {
+		suffix := config.EndpointSuffix
+		if suffix == "" {
+			suffix = defaultEndpointSuffix
+		}
+		target = url.URL{
 			Scheme: "https",
-			Host:   fmt.Sprintf("%s.blob.core.windows.net", config.AzureStorageAccount),
-			Path:   fmt.Sprintf("/%s", config.AzureStorageContainer),
-		},
+			Host:   fmt.Sprintf("%s.%s", config.AzureStorageAccount, suffix),
+			Path:   fmt.Sprintf("/%s", container),
+		}
+	}
+
+	if prefix := strings.Trim(config.UpstreamPathPrefix, "/"); prefix != "" {
+		target.Path = singleJoiningSlash(target.Path, prefix)
+	}
+	return &target
+}
+
+func normalizeExtensions(extensions []string) []string {
+	var normalized []string
+	for _, e := range extensions {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		normalized = append(normalized, e)
+	}
+	return normalized
+}
+
+func upstreamTimeout(config *Config) time.Duration {
+	if config.UpstreamTimeout == 0 {
+		return defaultUpstreamTimeout
 	}
+	return config.UpstreamTimeout
 }
 
-func NewStorageContainerReverseProxy(target *url.URL) *httputil.ReverseProxy {
-	targetQuery := target.RawQuery
+// newTransport builds the connection pool shared by the reverse proxy and the
+// HEAD helpers, so TLS connections to blob storage are reused.
+func newTransport(config *Config) *http.Transport {
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	maxIdleConnsPerHost := config.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	idleConnTimeout := config.IdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+
+	timeout := upstreamTimeout(config)
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+	}
+}
+
+// upstreamRecorder captures the last blob URL requested while serving a
+// request. Fallback middleware always serve the response of their last
+// attempt, so this is the URL the final response actually came from.
+type upstreamRecorder struct {
+	mu  sync.Mutex
+	url *url.URL
+}
+
+type upstreamRecorderContextKey struct{}
+
+func withUpstreamRecorder(req *http.Request) (*http.Request, *upstreamRecorder) {
+	rec := &upstreamRecorder{}
+	return req.WithContext(context.WithValue(req.Context(), upstreamRecorderContextKey{}, rec)), rec
+}
+
+func recordUpstream(req *http.Request) {
+	rec, ok := req.Context().Value(upstreamRecorderContextKey{}).(*upstreamRecorder)
+	if !ok {
+		return
+	}
+	u := *req.URL
+	rec.mu.Lock()
+	rec.url = &u
+	rec.mu.Unlock()
+}
+
+func (rec *upstreamRecorder) get() *url.URL {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.url
+}
+
+type publicURLContextKey struct{}
+
+func NewStorageContainerReverseProxy(defaultTarget *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
 	director := func(req *http.Request) {
+		// The host is about to become the blob host, so the public URL is
+		// kept for rewriteLocation.
+		*req = *req.WithContext(context.WithValue(req.Context(), publicURLContextKey{}, GetUrlFromRequest(req)))
+		target := TargetFromContext(req.Context(), defaultTarget)
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
-		}
+		req.URL.RawQuery = joinURLQuery(target, req.URL)
 		if _, ok := req.Header["User-Agent"]; !ok {
 			// explicitly disable User-Agent so it's not set to default value
 			req.Header.Set("User-Agent", "")
 		}
 		req.Host = target.Host
-		log.Printf("Proxy request to: %s\n", req.URL)
+		setClientRequestID(req)
+		recordUpstream(req)
+		LoggerFromContext(req.Context()).Debug("proxy request", "url", req.URL.String())
 	}
 	return &httputil.ReverseProxy{
-		Director: director,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Director:  director,
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteLocation(resp, TargetFromContext(resp.Request.Context(), defaultTarget))
+			return nil
 		},
+		ErrorHandler: proxyErrorHandler,
 	}
 }
 
-func (scp *StorageContainerProxyHandler) Listen() {
-	port := 3000
+// rewriteLocation points a Location header at the blob host, or at a path
+// under target's container, back at the proxy's public host, with the
+// container and path prefix stripped, so redirects don't send clients to the
+// storage account. Paths the proxy rewrote on the way in, such as env
+// subpaths, aren't mapped back.
+func rewriteLocation(resp *http.Response, target *url.URL) {
+	location := resp.Header.Get("Location")
+	public, ok := resp.Request.Context().Value(publicURLContextKey{}).(*url.URL)
+	if location == "" || !ok {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+	absolute := u.Host != ""
+	if absolute && !strings.EqualFold(u.Host, resp.Request.URL.Host) {
+		return
+	}
 
-	r := chi.NewRouter()
+	prefix := strings.TrimSuffix(target.EscapedPath(), "/")
+	rest, stripped := strings.CutPrefix(u.EscapedPath(), prefix)
+	stripped = stripped && prefix != "" && (rest == "" || strings.HasPrefix(rest, "/"))
+	if !absolute && !stripped {
+		return
+	}
+	if stripped {
+		if rest == "" {
+			rest = "/"
+		}
+		if p, err := url.PathUnescape(rest); err == nil {
+			u.Path, u.RawPath = p, rest
+		}
+	}
+	u.Scheme, u.Host = public.Scheme, public.Host
+	LoggerFromContext(resp.Request.Context()).Debug("rewriting upstream redirect", "location", location, "rewritten", u.String())
+	resp.Header.Set("Location", u.String())
+}
 
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins: []string{
-			"http://localhost",
-			"http://localhost:*",
-			"http://127.0.0.1",
-			fmt.Sprintf("https://%s", scp.BaseDomain),
-			fmt.Sprintf("https://*.%s", scp.BaseDomain),
-			fmt.Sprintf("%s://%s", scp.Target.Scheme, scp.Target.Host)},
-		AllowedHeaders: []string{"*"},
-	}))
-	r.Use(middleware.Compress(5))
-	if scp.UseSubdomains {
-		r.Use(SubdomainAsSubpath(scp.BaseDomain, scp.DefaultEnv))
-	} else {
-		r.Use(TryDefaultEnvOnNotFound(scp.DefaultEnv))
+type proxyErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// proxyErrorHandler answers with a JSON body rather than an empty page, which
+// also survives the buffering middleware since it is a normal response.
+func proxyErrorHandler(res http.ResponseWriter, req *http.Request, err error) {
+	logger := LoggerFromContext(req.Context())
+	stats.upstreamErrors.Add(1)
+
+	var certErr *tls.CertificateVerificationError
+	var netErr net.Error
+	var modifyErr *modifyResponseError
+	switch {
+	case errors.As(err, &modifyErr):
+		logger.Error("response hook failed", "url", req.URL.String(), "err", err)
+		writeJSON(res, req, http.StatusBadGateway, proxyErrorResponse{Error: "failed to process the blob storage response"})
+		return
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logger.Error("proxy request timed out", "url", req.URL.String(), "err", err)
+		writeJSON(res, req, http.StatusGatewayTimeout, proxyErrorResponse{Error: "blob storage did not respond in time"})
+		return
+	case errors.As(err, &certErr):
+		logger.Error("TLS certificate verification failed", "url", req.URL.String(), "err", err)
+	default:
+		logger.Error("proxy request failed", "url", req.URL.String(), "err", err)
 	}
-	r.Use(RedirectAssetsByExtension(scp.Target, []string{".jpg", ".png", ".jpeg", ".zip", ".js"}))
-	r.Use(middleware.ThrottleBacklog(5, 20000, 30*time.Second))
-	r.Use(TryIndexOnNotFound())
-	r.Use(AddHtmlIfNoExtensionAndNotFound())
-	r.Use(AddTrailingSlashIfNoExtensionAndNotFound(scp.Target))
-	r.Use(Md5Cache(scp.Target))
+	writeJSON(res, req, http.StatusBadGateway, proxyErrorResponse{Error: "blob storage is unreachable"})
+}
 
-	r.Handle("/*", NewStorageContainerReverseProxy(scp.Target))
+func (scp *StorageContainerProxyHandler) Listen() error {
+	return scp.ListenWithContext(context.Background())
+}
 
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), r)
+// ListenWithContext serves until ctx is cancelled, then drains active
+// connections for up to ShutdownGracePeriod. A clean shutdown returns nil.
+func (scp *StorageContainerProxyHandler) ListenWithContext(ctx context.Context) error {
+	router, err := scp.HandlerWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	tlsConfig, certManager, err := scp.tlsConfig()
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%e", err))
+		return err
+	}
+	servers := []*http.Server{{
+		Addr:      net.JoinHostPort(scp.ListenAddr, strconv.Itoa(scp.Port)),
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}}
+	if tlsConfig != nil && scp.HTTPPort != 0 {
+		// Plain HTTP goes through the same router, so HTTPSRedirect applies
+		// to it, except for ACME challenges.
+		var handler http.Handler = router
+		if certManager != nil {
+			handler = certManager.HTTPHandler(router)
+		}
+		servers = append(servers, &http.Server{
+			Addr:    net.JoinHostPort(scp.ListenAddr, strconv.Itoa(scp.HTTPPort)),
+			Handler: handler,
+		})
+	}
+	if scp.H2C && tlsConfig == nil {
+		// ConfigureServer lets Shutdown drain the hijacked h2c connections.
+		h2s := &http2.Server{}
+		if err := http2.ConfigureServer(servers[0], h2s); err != nil {
+			return err
+		}
+		servers[0].Handler = h2c.NewHandler(router, h2s)
+	}
+
+	listeners := make([]net.Listener, len(servers))
+	for i, server := range servers {
+		if i == 0 && scp.UnixSocket != "" {
+			listeners[i], err = listenUnix(scp.UnixSocket)
+		} else {
+			listeners[i], err = net.Listen("tcp", server.Addr)
+		}
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return err
+		}
 	}
+
+	errCh := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, l net.Listener, useTLS bool) {
+			if useTLS {
+				errCh <- server.ServeTLS(l, "", "")
+			} else {
+				errCh <- server.Serve(l)
+			}
+		}(server, listeners[i], i == 0 && tlsConfig != nil)
+	}
+
+	select {
+	case err := <-errCh:
+		for _, server := range servers {
+			server.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	scp.Logger.Info("shutting down, waiting for active connections", "gracePeriod", scp.ShutdownGracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), scp.ShutdownGracePeriod)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+	}
+
+	for range servers {
+		if err := <-errCh; err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return nil
 }
 
-func GetUrlFromRequest(req *http.Request) *url.URL {
-	scheme := "http"
-	if req.TLS != nil {
-		scheme = "https"
+// listenUnix listens on a Unix domain socket at path, which is removed again
+// when the listener is closed. A socket left behind by a process that didn't
+// shut down cleanly is replaced, but one that still accepts connections is
+// not.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
 	}
+	return net.Listen("unix", path)
+}
 
+// upstreamTransport wraps the shared connection pool with authentication and
+// instrumentation for every request sent to blob storage.
+func (scp *StorageContainerProxyHandler) upstreamTransport() (http.RoundTripper, error) {
+	var upstream http.RoundTripper = scp.Transport
+	switch scp.AuthMode {
+	case AuthModeNone:
+	case AuthModeSAS:
+		if scp.SASToken == "" {
+			return nil, errors.New("auth mode sas requires a SAS token")
+		}
+		upstream = newSASTransport(scp.SASToken, upstream)
+	case AuthModeManagedIdentity:
+		bearer, err := newManagedIdentityTransport(scp.ManagedIdentityID, upstream)
+		if err != nil {
+			return nil, err
+		}
+		upstream = bearer
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", scp.AuthMode)
+	}
+	if scp.Metrics {
+		upstream = instrumentRoundTripper(upstream)
+	}
+	if scp.Tracing {
+		upstream = traceRoundTripper(upstream)
+	}
+	if scp.MaxRetries > 0 {
+		upstream = newRetryTransport(scp.MaxRetries, scp.RetryBackoff, scp.UpstreamTimeout, upstream)
+	}
+	return upstream, nil
+}
+
+// Handler builds the fully configured proxy, middleware included, without
+// binding a socket, so it can be mounted in another router or served by an
+// httptest.Server. TLS termination is left to whoever serves it.
+func (scp *StorageContainerProxyHandler) Handler() (http.Handler, error) {
+	return scp.HandlerWithContext(context.Background())
+}
+
+// HandlerWithContext is Handler with background work, such as the rate
+// limiter's sweep of idle clients, stopping once ctx is done.
+func (scp *StorageContainerProxyHandler) HandlerWithContext(ctx context.Context) (http.Handler, error) {
+	return scp.newHostRouter(ctx)
+}
+
+// newHostRouter builds a router per entry in HostRoutes and picks one by the
+// request's Host, or returns the single router when there are no host routes.
+func (scp *StorageContainerProxyHandler) newHostRouter(ctx context.Context) (http.Handler, error) {
+	trusted, err := ParseTrustedProxies(scp.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	forwarded := ForwardedHeaders(trusted)
+
+	if len(scp.HostRoutes) == 0 {
+		router, err := scp.newRouter(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return forwarded(router), nil
+	}
+
+	routers := map[string]http.Handler{}
+	for host, hostHandler := range scp.HostRoutes {
+		router, err := hostHandler.newRouter(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("host route %s: %w", host, err)
+		}
+		routers[host] = router
+	}
+	healthz := HealthzHandler()
+
+	return forwarded(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host := hostWithoutPort(req.Host)
+		if router, ok := routers[host]; ok {
+			router.ServeHTTP(res, req)
+			return
+		}
+		// Probes usually address the pod directly, so liveness is answered
+		// whatever the host.
+		if req.URL.Path == "/healthz" {
+			healthz(res, req)
+			return
+		}
+		scp.Logger.Warn("no backend configured for host", "host", req.Host, "url", req.URL.String())
+		http.Error(res, fmt.Sprintf("no backend configured for host %q", host), http.StatusNotFound)
+	})), nil
+}
+
+// redirectExtensions are the RedirectExtensions not also in ForceDownloads,
+// which are proxied so they can be served with a Content-Disposition.
+func (scp *StorageContainerProxyHandler) redirectExtensions() []string {
+	if scp.RedirectMode == RedirectModeProxy {
+		return scp.RedirectExtensions
+	}
+	var redirected []string
+	for _, e := range scp.RedirectExtensions {
+		if hasExtension(e, scp.ForceDownloads) {
+			scp.Logger.Info("proxying rather than redirecting extension to force its download", "extension", e)
+			continue
+		}
+		redirected = append(redirected, e)
+	}
+	return redirected
+}
+
+func (scp *StorageContainerProxyHandler) newRouter(ctx context.Context) (http.Handler, error) {
+	if scp.CompressionLevel > 9 {
+		return nil, fmt.Errorf("compression level %d is out of range 0-9", scp.CompressionLevel)
+	}
+	if scp.CORSAllowCredentials {
+		for _, origin := range scp.CORSAllowedOrigins {
+			if origin == "*" {
+				return nil, errors.New("CORS credentials cannot be allowed for a wildcard origin")
+			}
+		}
+		for _, header := range scp.CORSAllowedHeaders {
+			if header == "*" {
+				scp.Logger.Warn("CORS allows any request header while allowing credentials")
+				break
+			}
+		}
+	}
+	if scp.LocalDir != "" {
+		if len(scp.ContainerTargets) > 0 {
+			return nil, errors.New("container routes cannot be used with a local directory")
+		}
+		info, err := os.Stat(scp.LocalDir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("local directory %s is not a directory", scp.LocalDir)
+		}
+	}
+
+	var accessLog func(http.Handler) http.Handler
+	if scp.AccessLog != "" {
+		var err error
+		accessLog, err = AccessLog(scp.AccessLogWriter, scp.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var headerRules func(http.Handler) http.Handler
+	if len(scp.HeaderRules) > 0 {
+		var err error
+		headerRules, err = RewriteHeaderRules(scp.HeaderRules)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rewrites func(http.Handler) http.Handler
+	if len(scp.RewriteRules) > 0 {
+		var err error
+		rewrites, err = RewritePaths(scp.RewriteRules)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var noFallbacks func(http.Handler) http.Handler
+	if len(scp.NoFallbackPaths) > 0 {
+		var err error
+		noFallbacks, err = BypassFallbacks(scp.NoFallbackPaths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var basicAuth func(http.Handler) http.Handler
+	if scp.BasicAuth.Enabled() {
+		var err error
+		basicAuth, err = BasicAuth(scp.BasicAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var favicon http.HandlerFunc
+	if scp.Favicon.Enabled() {
+		var err error
+		favicon, err = FaviconHandler(scp.Favicon)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ipFilter func(http.Handler) http.Handler
+	if len(scp.AllowCIDRs) > 0 || len(scp.DenyCIDRs) > 0 {
+		var err error
+		ipFilter, err = IPFilter(scp.AllowCIDRs, scp.DenyCIDRs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rateLimit func(http.Handler) http.Handler
+	if scp.RateLimitRPS > 0 {
+		rateLimit = RateLimit(ctx, scp.RateLimitRPS, scp.RateLimitBurst)
+	}
+
+	r := chi.NewRouter()
+	r.Use(WithLogger(scp.Logger))
+
+	upstream, err := scp.upstreamTransport()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: upstream,
+		Timeout:   scp.UpstreamTimeout,
+	}
+
+	// Health and operational routes are registered outside the group so
+	// they bypass the fallback and cache middleware. All but /healthz are
+	// still subject to the IP filter and rate limit, and those that reveal
+	// how the proxy is configured or used to basic auth.
+	var restrictions []func(http.Handler) http.Handler
+	if ipFilter != nil {
+		restrictions = append(restrictions, ipFilter)
+	}
+	if rateLimit != nil {
+		restrictions = append(restrictions, rateLimit)
+	}
+	restricted := r.With(restrictions...)
+	protected := restricted
+	if basicAuth != nil {
+		protected = restricted.With(basicAuth)
+	}
+	r.Get("/healthz", HealthzHandler())
+	if scp.LocalDir != "" {
+		restricted.Get("/readyz", HealthzHandler())
+	} else {
+		restricted.Get("/readyz", ReadyzHandler(scp.Target, client))
+	}
+	if scp.Metrics {
+		protected.Handle("/metrics", MetricsHandler())
+	}
+	if scp.Debug {
+		protected.Get("/_scproxy/explain", scp.ExplainHandler())
+		protected.Get("/_scproxy/config", ConfigHandler(scp.config))
+	}
+	if scp.StatsEndpoint {
+		protected.Get("/_scproxy/stats", StatsHandler())
+	}
+	if scp.RobotsTxt != "" {
+		r.Get("/robots.txt", RobotsTxtHandler(scp.RobotsTxt))
+		r.Head("/robots.txt", RobotsTxtHandler(scp.RobotsTxt))
+	}
+	if favicon != nil {
+		r.Get("/favicon.ico", favicon)
+		r.Head("/favicon.ico", favicon)
+	}
+	var store Cache
+	switch scp.CacheBackend {
+	case CacheBackendNone:
+		store = NoopCache{}
+	case CacheBackendRedis:
+		options, err := redis.ParseURL(scp.CacheRedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("redis cache: %w", err)
+		}
+		// Keys include the account, so host routes to different accounts
+		// can share one Redis.
+		store = NewRedisCache(redis.NewClient(options), "scproxy:"+scp.Target.Host+":", scp.CacheRedisTTL)
+	case CacheBackendDisk:
+		var err error
+		store, err = NewDiskCache(scp.CacheDir, scp.CacheMaxBytes, scp.CacheMaxEntries, scp.Logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The cache compresses entries once itself, which the Compress
+	// middleware then passes through untouched.
+	gzipLevel := 0
+	if scp.CompressionLevel > 0 {
+		gzipLevel = scp.CompressionLevel
+	}
+	cache := NewMd5ResponseCache(CacheOptions{
+		EntryLifetime:        scp.CacheTTL,
+		ErrorBackoff:         scp.CacheErrorBackoff,
+		StaleWhileRevalidate: scp.StaleWhileRevalidate,
+		MaxBytes:             scp.CacheMaxBytes,
+		MaxEntries:           scp.CacheMaxEntries,
+		CacheableStatusCodes: scp.CacheableStatusCodes,
+		CacheableMethods:     scp.CacheableMethods,
+		GzipLevel:            gzipLevel,
+		CompressibleTypes:    scp.CompressibleTypes,
+		Logger:               scp.Logger,
+		Store:                store,
+	}, client)
+	var notFoundCache *NotFoundCache
+	if scp.NegativeCacheTTL > 0 {
+		notFoundCache = NewNotFoundCache(scp.NegativeCacheTTL, scp.NegativeCacheEntries)
+	}
+	if scp.AdminToken != "" {
+		admin := restricted.With(RequireAdminToken(scp.AdminToken))
+		admin.Post("/_scproxy/purge", PurgeHandler(cache, scp.Target, scp.ContainerTargets))
+		admin.Post("/_scproxy/invalidate", InvalidateHandler(cache, notFoundCache))
+	}
+
+	r.Group(func(r chi.Router) {
+		if scp.Tracing {
+			r.Use(TraceRequests())
+		}
+		r.Use(TagRequests())
+		if accessLog != nil {
+			r.Use(accessLog)
+		}
+		if ipFilter != nil {
+			r.Use(ipFilter)
+		}
+		if rateLimit != nil {
+			r.Use(rateLimit)
+		}
+		r.Use(CountStats())
+		if scp.Metrics {
+			r.Use(CountRequests())
+		}
+		if scp.HTTPSRedirect {
+			r.Use(RedirectToHTTPS(scp.httpsPort()))
+		}
+		r.Use(cors.Handler(cors.Options{
+			AllowedOrigins:   scp.CORSAllowedOrigins,
+			AllowedMethods:   scp.CORSAllowedMethods,
+			AllowedHeaders:   scp.CORSAllowedHeaders,
+			ExposedHeaders:   scp.CORSExposedHeaders,
+			AllowCredentials: scp.CORSAllowCredentials,
+			// AnswerOptions answers preflights once the headers are set.
+			OptionsPassthrough: true,
+		}))
+		// After CORS, so a rejected request still carries the CORS headers
+		// the browser needs to show the script its status.
+		if len(scp.AllowedMethods) > 0 {
+			r.Use(AllowMethods(scp.AllowedMethods))
+		}
+		r.Use(AnswerOptions(scp.AllowedMethods))
+		// After CORS, so preflight requests, which never carry credentials,
+		// are still answered.
+		if basicAuth != nil {
+			r.Use(basicAuth)
+		}
+		if scp.CompressionLevel >= 0 {
+			r.Use(middleware.Compress(scp.CompressionLevel, scp.CompressibleTypes...))
+		}
+		if scp.MaxBufferBytes > 0 {
+			r.Use(LimitBuffering(scp.MaxBufferBytes))
+		}
+		if scp.SecurityHeaders.Enabled() {
+			r.Use(SecurityHeaders(scp.SecurityHeaders))
+		}
+		if scp.DefaultCacheControl != "" || scp.HTMLCacheControl != "" {
+			r.Use(DefaultCacheControl(scp.HTMLCacheControl, scp.DefaultCacheControl))
+		}
+		if headerRules != nil {
+			r.Use(headerRules)
+		}
+		// Inside the header rules, so a rule can still override the
+		// disposition.
+		if len(scp.ForceDownloads) > 0 {
+			r.Use(ForceDownload(scp.ForceDownloads))
+		}
+		if noFallbacks != nil {
+			r.Use(noFallbacks)
+		}
+		if rewrites != nil {
+			r.Use(rewrites)
+		}
+		// Outside the custom error page and listings, so removing a slash
+		// waits for the real 404 and a listed directory keeps its slash.
+		if scp.TrailingSlashPolicy != TrailingSlashNone {
+			r.Use(NormalizeTrailingSlash(scp.TrailingSlashPolicy))
+		}
+		if scp.CanonicalizeIndex {
+			r.Use(CanonicalizeIndex(scp.IndexDocument))
+		}
+		if len(scp.StripHeaderPrefixes) > 0 {
+			r.Use(StripUpstreamHeaders(scp.StripHeaderPrefixes))
+		}
+		if len(scp.ContainerTargets) > 0 {
+			r.Use(RouteContainers(scp.ContainerTargets))
+		}
+		if scp.NotFoundPage != "" {
+			r.Use(ServeCustomErrorPage(scp.Target, scp.NotFoundPage))
+		}
+		var fallbackEnvs []string
+		if scp.UseSubdomains {
+			r.Use(SubdomainAsSubpath(scp.BaseDomain, scp.DefaultEnv, scp.HostMismatchAction, scp.HostRedirectTo))
+		} else {
+			fallbackEnvs = scp.FallbackEnvs
+		}
+		// Outside the cache, so listings are always current and never stored
+		// under the path's MD5.
+		if scp.DirectoryListing && scp.LocalDir == "" {
+			r.Use(ListDirectories(scp.Target, scp.UpstreamPathPrefix, scp.DirectoryListingLimit, client))
+		}
+		// Assets can't be redirected to a local directory, so they are served
+		// like everything else.
+		if len(scp.RedirectExtensions) > 0 && scp.LocalDir == "" {
+			r.Use(RedirectAssetsByExtension(scp.Target, scp.redirectExtensions(), scp.RedirectMode))
+		}
+		// The cache wraps the fallbacks so it stores the resolved response
+		// rather than the upstream 404 that triggered a fallback.
+		if len(scp.CacheableMethods) > 0 {
+			r.Use(CacheResponses(scp.Target, cache))
+		}
+		if notFoundCache != nil {
+			r.Use(CacheNotFoundIn(scp.Target, notFoundCache))
+		}
+		r.Use(middleware.ThrottleBacklog(5, 20000, 30*time.Second))
+		r.Use(ResolveFallbacks(FallbackOptions{
+			Envs:                  fallbackEnvs,
+			IndexDocument:         scp.IndexDocument,
+			ForceHtmlContentType:  scp.ForceHtmlContentType,
+			MaxFallbacks:          scp.MaxFallbacks,
+			SPAMode:               scp.SPAMode,
+			RedirectTrailingSlash: scp.RedirectTrailingSlash,
+		}))
+		// Inside the fallbacks, so a path resolved to an index document isn't
+		// served with the content type of the extension requested.
+		if len(scp.ContentTypeOverrides) > 0 {
+			r.Use(OverrideContentTypes(scp.ContentTypeOverrides))
+		}
+		// Variants are tried per fallback candidate, so a missing .br never
+		// falls back to another path's index document.
+		if scp.ServePrecompressed {
+			r.Use(ServePrecompressed(scp.Target))
+		}
+
+		if scp.LocalDir != "" {
+			r.Handle("/*", LocalFileServer(scp.LocalDir))
+		} else {
+			reverseProxy := NewStorageContainerReverseProxy(scp.Target, upstream)
+			if scp.ModifyResponse != nil {
+				withResponseModifier(reverseProxy, scp.ModifyResponse)
+			}
+			r.Handle("/*", reverseProxy)
+		}
+	})
+
+	return r, nil
+}
+
+func GetUrlFromRequest(req *http.Request) *url.URL {
 	return &url.URL{
-		Scheme: scheme,
+		Scheme: RequestScheme(req),
 		Host:   req.Host,
 	}
 }
 
-func SubdomainAsSubpath(domain string, env string) func(http.Handler) http.Handler {
-	domainDotCount := strings.Count(domain, ".")
+// hostWithoutPort lowercases host and strips any port, including from
+// bracketed IPv6 literals such as [::1]:3000.
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// subdomainPath maps host to a path prefix under domain: the bare domain to
+// env and a single subdomain to itself. A returned error describes a host the
+// client shouldn't have sent.
+func subdomainPath(host string, path string, domain string, env string) (string, error) {
+	host = hostWithoutPort(host)
+	domain = strings.ToLower(domain)
+	if host == domain {
+		return "/" + env + path, nil
+	}
+	subdomain, ok := strings.CutSuffix(host, "."+domain)
+	if !ok || subdomain == "" {
+		return "", fmt.Errorf("host %s does not match base domain %s", host, domain)
+	}
+	if strings.Contains(subdomain, ".") {
+		return "", fmt.Errorf("host %s has too many subdomains for base domain %s", host, domain)
+	}
+	return "/" + subdomain + path, nil
+}
+
+type HostMismatchAction string
+
+const (
+	// HostMismatchError answers a 400 naming the problem with the host.
+	HostMismatchError HostMismatchAction = "error"
+	// HostMismatchRedirect sends the client a 301 to the same path and query
+	// under a canonical URL.
+	HostMismatchRedirect HostMismatchAction = "redirect"
+	// HostMismatchDefaultEnv serves the request from the default env, as if
+	// it had been made to the bare base domain.
+	HostMismatchDefaultEnv HostMismatchAction = "defaultEnv"
+)
+
+func ParseHostMismatchAction(s string) (HostMismatchAction, error) {
+	for _, action := range []HostMismatchAction{HostMismatchError, HostMismatchRedirect, HostMismatchDefaultEnv} {
+		if strings.EqualFold(s, string(action)) {
+			return action, nil
+		}
+	}
+	return "", fmt.Errorf("unknown host mismatch action %q", s)
+}
+
+// SubdomainAsSubpath prefixes the path with the env the host maps to under
+// domain. Hosts that don't map to an env are handled as mismatch says, with
+// redirectTo as the canonical URL for HostMismatchRedirect.
+func SubdomainAsSubpath(domain string, env string, mismatch HostMismatchAction, redirectTo *url.URL) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-			host := req.Host
-			if strings.Contains(host, ":") {
-				host = host[:strings.Index(host, ":")]
-			}
-			if !strings.HasSuffix(host, domain) {
-				log.Printf("ERROR: %s did not match base domain %s", host, domain)
-				res.WriteHeader(500)
-				return
+			path, err := subdomainPath(req.Host, req.URL.Path, domain, env)
+			if err != nil {
+				LoggerFromContext(req.Context()).Warn("host did not map to a path", "host", req.Host, "domain", domain, "url", req.URL.String(), "client", req.RemoteAddr, "action", mismatch, "err", err)
+				switch mismatch {
+				case HostMismatchDefaultEnv:
+					path = "/" + env + req.URL.Path
+				case HostMismatchRedirect:
+					requested := requestedURL(req)
+					location := *redirectTo
+					location.Path = singleJoiningSlash(location.Path, requested.Path)
+					location.RawPath = ""
+					location.RawQuery = requested.RawQuery
+					http.Redirect(res, req, location.String(), http.StatusMovedPermanently)
+					return
+				default:
+					http.Error(res, err.Error(), http.StatusBadRequest)
+					return
+				}
 			}
-			hostDotCount := strings.Count(host, ".")
 			req.URL.RawPath = ""
-			if hostDotCount == domainDotCount {
-				// Default path
-				req.URL.Path = "/" + env + req.URL.Path
-			} else if hostDotCount == domainDotCount+1 {
-				// Sub-path
-				req.URL.Path = "/" + strings.TrimSuffix(host, "."+domain) + req.URL.Path
-				log.Printf("[INFO] updated url path to: %s, based on subdomain", req.URL.Path)
-			} else {
-				// Too many subdomains
-				log.Printf("ERROR: %s had too many subdomains compared to %s", host, domain)
-				res.WriteHeader(500)
-				return
-			}
+			req.URL.Path = path
+			LoggerFromContext(req.Context()).Debug("updated url path based on subdomain", "path", req.URL.Path)
 			next.ServeHTTP(res, req)
 		})
 	}
 }
 
-func CheckUrlExists(target *url.URL) (int, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
-	}
+func CheckUrlExists(target *url.URL, client *http.Client) (int, error) {
 	resp, err := client.Head(target.String())
 	if err != nil {
 		return -1, err
@@ -171,120 +1550,286 @@ func CheckUrlExists(target *url.URL) (int, error) {
 	return resp.StatusCode, nil
 }
 
-func AddHtmlIfNoExtensionAndNotFound() func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-			w := NewCachedResponseWriter()
+type fallbackCandidate struct {
+	path string
+	kind string
+}
 
-			next.ServeHTTP(w, req)
+type FallbackOptions struct {
+	// Envs are tried after the original path.
+	Envs []string
+	// IndexDocument defaults to index.html.
+	IndexDocument string
+	// ForceHtmlContentType serves a successful .html fallback as text/html.
+	ForceHtmlContentType bool
+	// MaxFallbacks caps the fallbacks tried per client request, zero means
+	// no limit.
+	MaxFallbacks int
+	// SPAMode finally tries the index document at the root of each env for
+	// extensionless paths.
+	SPAMode bool
+	// RedirectTrailingSlash redirects to the client's path with a trailing
+	// slash when a dir/<index> fallback is found, rather than serving it.
+	RedirectTrailingSlash bool
+}
 
-			if w.StatusCode == 404 && !strings.HasSuffix(req.URL.Path, "/") && filepath.Ext(req.URL.Path) == "" {
-				req.URL.RawPath = ""
-				req.URL.Path = req.URL.Path + ".html"
-				next.ServeHTTP(res, req)
-			} else {
-				err := w.WriteTo(res)
-				if err != nil {
-					res.WriteHeader(500)
-					log.Printf("[ERROR] %v\n", err)
-				}
+type fallbackCountContextKey struct{}
+
+// withFallbackCount returns req carrying a count of the fallbacks tried for
+// it, reusing one already in its context so that every dispatch of the same
+// client request adds to the same count.
+func withFallbackCount(req *http.Request) (*http.Request, *int) {
+	if count, ok := req.Context().Value(fallbackCountContextKey{}).(*int); ok {
+		return req, count
+	}
+	count := new(int)
+	return req.WithContext(context.WithValue(req.Context(), fallbackCountContextKey{}, count)), count
+}
+
+// fallbackCandidates lists the paths to try for path, in order. Each base path
+// (path itself, then path under each of envs) is tried as-is, then for
+// extensionless paths with .html appended and as dir/<index>, and finally as
+// the index document next to it. Pretty URLs for page.html are the common
+// case, so they cost one request after the miss. With spa, an extensionless
+// path is lastly tried as the index document under each base's first
+// segment, which is its env. Duplicates are dropped.
+func fallbackCandidates(path string, envs []string, index string, spa bool) []fallbackCandidate {
+	bases := []fallbackCandidate{{path: path}}
+	leadingSegment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	for _, env := range envs {
+		if env != "" && env != leadingSegment {
+			bases = append(bases, fallbackCandidate{path: "/" + env + path, kind: fallbackDefaultEnv})
+		}
+	}
+
+	var candidates []fallbackCandidate
+	seen := map[string]bool{}
+	add := func(c fallbackCandidate) {
+		if !seen[c.path] {
+			seen[c.path] = true
+			candidates = append(candidates, c)
+		}
+	}
+	for _, base := range bases {
+		add(base)
+		if !strings.HasSuffix(base.path, "/") && filepath.Ext(base.path) == "" {
+			add(fallbackCandidate{path: base.path + ".html", kind: fallbackHtml})
+			add(fallbackCandidate{path: base.path + "/" + index, kind: fallbackTrailingSlash})
+		}
+		if !strings.HasSuffix(base.path, "/"+index) {
+			add(fallbackCandidate{path: indexPathFor(base.path, index), kind: fallbackIndex})
+		}
+	}
+	if spa && filepath.Ext(path) == "" {
+		for _, base := range bases {
+			env, _, nested := strings.Cut(strings.TrimPrefix(base.path, "/"), "/")
+			shell := "/" + index
+			if nested {
+				shell = "/" + env + shell
 			}
-		})
+			add(fallbackCandidate{path: shell, kind: fallbackSPA})
+		}
 	}
+	return candidates
 }
 
-func AddTrailingSlashIfNoExtensionAndNotFound(target *url.URL) func(next http.Handler) http.Handler {
+// ResolveFallbacks serves the first of the fallback candidates for the request
+// path that isn't a 404, making a single pass down the chain per candidate.
+func ResolveFallbacks(options FallbackOptions) func(next http.Handler) http.Handler {
+	index := options.IndexDocument
+	if index == "" {
+		index = defaultIndexDocument
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-			w := NewCachedResponseWriter()
-
-			next.ServeHTTP(w, req)
+			if fallbacksBypassed(req) {
+				next.ServeHTTP(res, req)
+				return
+			}
+			req, tried := withFallbackCount(req)
+			var w *CachedResponseWriter
+			var served fallbackCandidate
+			for _, candidate := range fallbackCandidates(req.URL.Path, options.Envs, index, options.SPAMode) {
+				if w != nil {
+					if w.StatusCode != 404 || w.Committed() {
+						break
+					}
+					if options.MaxFallbacks > 0 && *tried >= options.MaxFallbacks {
+						LoggerFromContext(req.Context()).Warn("fallback limit reached", "url", req.URL.String(), "maxFallbacks", options.MaxFallbacks)
+						break
+					}
+					*tried++
+					LoggerFromContext(req.Context()).Info("not found, trying fallback", "url", req.URL.String(), "fallback", candidate.path, "kind", candidate.kind)
+					countFallback(candidate.kind)
+				}
 
-			if w.StatusCode == 404 && !strings.HasSuffix(req.URL.Path, "/") && filepath.Ext(req.URL.Path) == "" {
-				log.Printf("%s was not found, trying %s/index.html instead\n", req.URL.String(), req.URL.String())
-				req.URL.RawPath = ""
-				req.URL.Path = req.URL.Path + "/index.html"
+				candidateReq := req.Clone(req.Context())
+				candidateReq.URL.RawPath = ""
+				candidateReq.URL.Path = candidate.path
 
-				next.ServeHTTP(res, req)
-			} else {
-				err := w.WriteTo(res)
-				if err != nil {
-					res.WriteHeader(500)
-					log.Printf("[ERROR] %v\n", err)
+				candidateRes := newBufferedWriter(res, req)
+				if options.ForceHtmlContentType && candidate.kind == fallbackHtml {
+					candidateRes.RewriteHeaders(func(header http.Header) {
+						if candidateRes.StatusCode == 200 {
+							header.Set("Content-Type", "text/html; charset=utf-8")
+						}
+					})
 				}
+				next.ServeHTTP(candidateRes, candidateReq)
+				w = candidateRes
+				served = candidate
+			}
+
+			if options.RedirectTrailingSlash && served.kind == fallbackTrailingSlash && !w.Committed() &&
+				(w.StatusCode == http.StatusOK || w.StatusCode == http.StatusNotModified) {
+				location := trailingSlashLocation(req)
+				LoggerFromContext(req.Context()).Info("redirecting to trailing slash", "url", req.URL.String(), "location", location)
+				http.Redirect(res, req, location, http.StatusMovedPermanently)
+				return
+			}
+
+			err := w.WriteTo(res)
+			if err != nil {
+				res.WriteHeader(500)
+				LoggerFromContext(req.Context()).Error("failed to write response", "err", err)
 			}
 		})
 	}
 }
 
-func TryDefaultEnvOnNotFound(defaultEnv string) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-			w := NewCachedResponseWriter()
+// requestedURL is the URL the client requested. It is read from RequestURI
+// since req.URL may have been routed or rewritten to a blob path by now.
+func requestedURL(req *http.Request) *url.URL {
+	if parsed, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		return parsed
+	}
+	return req.URL
+}
 
-			next.ServeHTTP(w, req)
+// trailingSlashLocation is the path the client requested with a slash
+// appended, keeping its query.
+func trailingSlashLocation(req *http.Request) string {
+	u := requestedURL(req)
+	location := u.EscapedPath() + "/"
+	if u.RawQuery != "" {
+		location += "?" + u.RawQuery
+	}
+	return location
+}
 
-			if w.StatusCode == 404 {
-				newPath := "/" + defaultEnv + req.URL.Path
-				log.Printf("%s was not found (path: %s), trying %s instead\n", req.URL.String(), req.URL.Path, newPath)
-				req.URL.RawPath = ""
-				req.URL.Path = newPath
-				next.ServeHTTP(res, req)
-			} else {
-				err := w.WriteTo(res)
-				if err != nil {
-					res.WriteHeader(500)
-					log.Printf("[ERROR] %v\n", err)
+// StripUpstreamHeaders removes response headers whose names start with any of
+// prefixes, compared case-insensitively, to avoid leaking backend details.
+func StripUpstreamHeaders(prefixes []string) func(next http.Handler) http.Handler {
+	var lowered []string
+	for _, p := range prefixes {
+		lowered = append(lowered, strings.ToLower(p))
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			serveRewritingHeaders(res, req, next, func(status int, header http.Header) {
+				for name := range header {
+					lowerName := strings.ToLower(name)
+					for _, p := range lowered {
+						if strings.HasPrefix(lowerName, p) {
+							header.Del(name)
+							break
+						}
+					}
 				}
-
-				return
-			}
+			})
 		})
 	}
 }
 
-func TryIndexOnNotFound() func(next http.Handler) http.Handler {
+// ServeCustomErrorPage replaces a final 404 with the body of errorPath, which
+// is requested through the rest of the chain like any other path.
+func ServeCustomErrorPage(target *url.URL, errorPath string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-			w := NewCachedResponseWriter()
+			if fallbacksBypassed(req) {
+				next.ServeHTTP(res, req)
+				return
+			}
+			// The page request shares the fallback count with the request
+			// that 404'd, so MaxFallbacks bounds both together.
+			req, _ = withFallbackCount(req)
+			w := newBufferedWriter(res, req)
 
-			next.ServeHTTP(w, req)
+			next.ServeHTTP(w, req.Clone(req.Context()))
 
-			if w.StatusCode == 404 && !strings.HasSuffix(req.URL.Path, "/index.html") {
-				log.Printf("%s was not found (path: %s), trying index.html instead\n", req.URL.String(), req.URL.Path)
-				req.URL.RawPath = ""
-				req.URL.Path = req.URL.Path[:strings.LastIndex(req.URL.Path, "/")] + "/index.html"
-				next.ServeHTTP(res, req)
-			} else {
-				err := w.WriteTo(res)
-				if err != nil {
-					res.WriteHeader(500)
-					log.Printf("[ERROR] %v\n", err)
+			if w.StatusCode == 404 && !w.Committed() && req.Method == http.MethodGet {
+				errorReq := req.Clone(req.Context())
+				errorReq.URL.RawPath = ""
+				errorReq.URL.Path = errorPath
+				errorReq.URL.RawQuery = ""
+
+				page := NewCachedResponseWriter()
+				next.ServeHTTP(page, errorReq)
+				if page.StatusCode == 200 {
+					LoggerFromContext(req.Context()).Info("not found, serving error page", "url", req.URL.String(), "errorPage", TargetFromContext(req.Context(), target).Path+errorPath)
+					page.StatusCode = 404
+					page.Header().Set("Content-Type", "text/html; charset=utf-8")
+					w = page
+				} else {
+					LoggerFromContext(req.Context()).Warn("error page could not be served", "errorPage", errorPath, "status", page.StatusCode)
 				}
+			}
 
-				return
+			err := w.WriteTo(res)
+			if err != nil {
+				res.WriteHeader(500)
+				LoggerFromContext(req.Context()).Error("failed to write response", "err", err)
 			}
 		})
 	}
 }
 
-func RedirectAssetsByExtension(target *url.URL, extensions []string) func(http.Handler) http.Handler {
-	targetQuery := target.RawQuery
+type RedirectMode string
+
+const (
+	// RedirectModeRedirect sends the client a 302 to the public blob URL.
+	RedirectModeRedirect RedirectMode = "redirect"
+	// RedirectModeProxy streams the asset through the proxy instead. The
+	// request continues down the chain, so it is still served from and stored
+	// in the MD5 cache like any other path.
+	RedirectModeProxy RedirectMode = "proxy"
+)
+
+func ParseRedirectMode(s string) (RedirectMode, error) {
+	switch mode := RedirectMode(strings.ToLower(s)); mode {
+	case RedirectModeRedirect, RedirectModeProxy:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown redirect mode %q", s)
+}
+
+// indexPathFor returns the index document next to path, falling back to the
+// root index when path has no directory component.
+func indexPathFor(path string, index string) string {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "/" + index
+	}
+	return path[:i] + "/" + index
+}
+
+func RedirectAssetsByExtension(defaultTarget *url.URL, extensions []string, mode RedirectMode) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			target := TargetFromContext(req.Context(), defaultTarget)
 			ext := filepath.Ext(req.URL.Path)
-			log.Printf("[INFO] extension is: %s\n", ext)
+			LoggerFromContext(req.Context()).Debug("checking extension", "ext", ext)
 			for _, e := range extensions {
-				if ext == e {
+				if strings.EqualFold(ext, e) {
+					if mode == RedirectModeProxy {
+						break
+					}
+
 					redirectUrl := url.URL{}
 					redirectUrl.Scheme = target.Scheme
 					redirectUrl.Host = target.Host
 					redirectUrl.Path, req.URL.RawPath = joinURLPath(target, req.URL)
-					if targetQuery == "" || req.URL.RawQuery == "" {
-						redirectUrl.RawQuery = targetQuery + req.URL.RawQuery
-					} else {
-						redirectUrl.RawQuery = targetQuery + "&" + req.URL.RawQuery
-					}
+					redirectUrl.RawQuery = joinURLQuery(target, req.URL)
 
 					http.Redirect(res, req, redirectUrl.String(), 302)
 					return
@@ -296,30 +1841,87 @@ func RedirectAssetsByExtension(target *url.URL, extensions []string) func(http.H
 	}
 }
 
-func Md5Cache(target *url.URL) func(next http.Handler) http.Handler {
-	cache := NewMd5ResponseCache(10 * time.Second)
+func Md5Cache(defaultTarget *url.URL, client *http.Client, options CacheOptions) func(next http.Handler) http.Handler {
+	return CacheResponses(defaultTarget, NewMd5ResponseCache(options, client))
+}
+
+// CacheResponses serves from and populates cache, which the caller keeps to
+// purge entries from.
+func CacheResponses(defaultTarget *url.URL, cache *ResponseCache) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			target := TargetFromContext(req.Context(), defaultTarget)
+			// Partial content is streamed straight through rather than buffered
+			// and cached, so the backend's 206 reaches the client.
+			if req.Header.Get("Range") != "" || !cache.Cacheable(req.Method) {
+				recordCacheResult(req, "bypass")
+				next.ServeHTTP(res, req)
+				return
+			}
+
 			urlCopy := &url.URL{}
 			*urlCopy = *target
 			urlCopy.Path, urlCopy.RawPath = joinURLPath(urlCopy, req.URL)
+			urlCopy.RawQuery = joinURLQuery(target, req.URL)
+			acceptEncoding := req.Header.Get("Accept-Encoding")
 
-			cachedRes := cache.get(req.Method, urlCopy)
+			cachedRes := cache.get(req.Context(), req.Method, urlCopy, acceptEncoding)
 			if cachedRes != nil {
-				log.Printf("[INFO] found a cached version for %s\n", req.URL.String())
+				recordCacheResult(req, "hit")
+				if etagMatches(req.Header.Get("If-None-Match"), cachedRes.Header().Get("ETag")) {
+					LoggerFromContext(req.Context()).Debug("client has the cached version", "url", req.URL.String())
+					writeNotModified(res, cachedRes.Header())
+					return
+				}
+				LoggerFromContext(req.Context()).Debug("found a cached version", "url", req.URL.String())
 				cachedRes.WriteTo(res)
 				return
 			}
 
-			log.Printf("[INFO] update cache for %s\n", req.URL.String())
-			innerRes := NewCachedResponseWriter()
+			recordCacheResult(req, "miss")
+			// On a miss, conditional requests are forwarded untouched so the
+			// backend can answer 304. Those responses can't populate the cache.
+			if isConditionalRequest(req) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			// Concurrent misses for the same response wait for the first one's
+			// fetch rather than each going to blob storage.
+			fetchKey := req.Method + " " + cacheKey(urlCopy, acceptEncoding)
+			fetch, first := cache.startFetch(fetchKey)
+			if !first {
+				if shared := fetch.wait(req.Context()); shared != nil {
+					LoggerFromContext(req.Context()).Debug("shared an in-flight fetch", "url", req.URL.String())
+					shared.WriteTo(res)
+					return
+				}
+			}
+
+			LoggerFromContext(req.Context()).Debug("update cache", "url", req.URL.String())
+			innerRes := newBufferedWriter(res, req)
+			if first {
+				defer cache.finishFetch(fetchKey, fetch, nil)
+			}
+			req, rec := withUpstreamRecorder(req)
 			next.ServeHTTP(innerRes, req)
-			cache.put(req.Method, urlCopy, innerRes)
+			upstream := rec.get()
+			if upstream == nil {
+				upstream = urlCopy
+			}
+			cache.put(req.Context(), req.Method, urlCopy, upstream, acceptEncoding, innerRes)
+			if first {
+				cache.finishFetch(fetchKey, fetch, innerRes)
+			}
 			innerRes.WriteTo(res)
 		})
 	}
 }
 
+func isConditionalRequest(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
@@ -332,6 +1934,13 @@ func singleJoiningSlash(a, b string) string {
 	return a + b
 }
 
+func joinURLQuery(a, b *url.URL) string {
+	if a.RawQuery == "" || b.RawQuery == "" {
+		return a.RawQuery + b.RawQuery
+	}
+	return a.RawQuery + "&" + b.RawQuery
+}
+
 func joinURLPath(a, b *url.URL) (path, rawpath string) {
 	if a.RawPath == "" && b.RawPath == "" {
 		return singleJoiningSlash(a.Path, b.Path), ""
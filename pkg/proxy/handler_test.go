@@ -0,0 +1,842 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// fakeContainer serves blobs like blob storage does, with their Content-MD5,
+// and counts the requests for each path.
+type fakeContainer struct {
+	mu       sync.Mutex
+	blobs    map[string]string
+	requests map[string]int
+}
+
+func newFakeContainer(blobs map[string]string) *fakeContainer {
+	c := &fakeContainer{blobs: map[string]string{}, requests: map[string]int{}}
+	for p, body := range blobs {
+		c.blobs[p] = body
+	}
+	return c
+}
+
+func (c *fakeContainer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	c.requests[req.URL.Path]++
+	body, ok := c.blobs[req.URL.Path]
+	c.mu.Unlock()
+
+	if !ok {
+		res.Header().Set("x-ms-error-code", "BlobNotFound")
+		http.Error(res, "The specified blob does not exist.", http.StatusNotFound)
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(req.URL.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Md5", contentMd5Of(body))
+	res.Header().Set("x-ms-blob-type", "BlockBlob")
+	if req.Method != http.MethodHead {
+		res.Write([]byte(body))
+	}
+}
+
+func (c *fakeContainer) set(p string, body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs[p] = body
+}
+
+// hits returns how often each path was requested and resets the counts.
+func (c *fakeContainer) hits() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hits := c.requests
+	c.requests = map[string]int{}
+	return hits
+}
+
+// newTestProxy serves config's proxy in front of upstream, which stands in
+// for a storage account whose container is named c unless config says
+// otherwise.
+func newTestProxy(t *testing.T, config Config, upstream http.Handler) http.Handler {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.BlobEndpoint = endpoint
+	if config.AzureStorageContainer == "" {
+		config.AzureStorageContainer = "c"
+	}
+	if config.Logger == nil {
+		config.Logger = discardLogger()
+	}
+	h, err := NewHandler(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler, err := h.HandlerWithContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// get sends a GET for target, a path or absolute URL, through handler.
+func get(handler http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestCacheStoresResolvedFallback(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/docs/index.html": "docs"})
+	proxy := newTestProxy(t, Config{CacheTTL: time.Hour}, container)
+
+	if rec := get(proxy, "/docs/"); rec.Code != http.StatusOK || rec.Body.String() != "docs" {
+		t.Fatalf("first request = %d %q, want 200 docs", rec.Code, rec.Body.String())
+	}
+	if hits := container.hits(); hits["/c/docs/"] != 1 || hits["/c/docs/index.html"] != 1 {
+		t.Fatalf("first request made upstream requests %v, want the directory and its index once each", hits)
+	}
+
+	if rec := get(proxy, "/docs/"); rec.Code != http.StatusOK || rec.Body.String() != "docs" {
+		t.Fatalf("cached request = %d %q, want 200 docs", rec.Code, rec.Body.String())
+	}
+	if hits := container.hits(); len(hits) != 0 {
+		t.Errorf("cached request made upstream requests %v, want none", hits)
+	}
+}
+
+func TestCacheServesPathFoundAfterNotFound(t *testing.T) {
+	container := newFakeContainer(nil)
+	proxy := newTestProxy(t, Config{CacheTTL: time.Hour}, container)
+
+	if rec := get(proxy, "/page.txt"); rec.Code != http.StatusNotFound {
+		t.Fatalf("missing blob = %d, want 404", rec.Code)
+	}
+	container.set("/c/page.txt", "uploaded")
+	if rec := get(proxy, "/page.txt"); rec.Code != http.StatusOK || rec.Body.String() != "uploaded" {
+		t.Errorf("uploaded blob = %d %q, want 200 uploaded", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStripUpstreamHeaders(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/app.js": "app"})
+	for _, tc := range []struct {
+		name     string
+		prefixes []string
+		gone     []string
+		kept     []string
+	}{
+		{name: "default", prefixes: nil, gone: []string{"X-Ms-Blob-Type"}, kept: []string{"Content-Md5"}},
+		{name: "custom", prefixes: []string{"X-MS-", "content-md5"}, gone: []string{"X-Ms-Blob-Type", "Content-Md5"}},
+		{name: "none", prefixes: []string{}, kept: []string{"X-Ms-Blob-Type", "Content-Md5"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := newTestProxy(t, Config{StripHeaderPrefixes: tc.prefixes}, container)
+			rec := get(proxy, "/app.js")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			for _, name := range tc.gone {
+				if v := rec.Header().Values(name); len(v) > 0 {
+					t.Errorf("%s = %q, want it stripped", name, v)
+				}
+			}
+			for _, name := range tc.kept {
+				if rec.Header().Get(name) == "" {
+					t.Errorf("%s was stripped, want it kept", name)
+				}
+			}
+		})
+	}
+}
+
+func TestForceHtmlContentType(t *testing.T) {
+	// The blob's content type metadata was lost on upload.
+	upstream := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/c/about.html" {
+			http.NotFound(res, req)
+			return
+		}
+		res.Header().Set("Content-Type", "application/octet-stream")
+		res.Write([]byte("<h1>About</h1>"))
+	})
+	for _, tc := range []struct {
+		name  string
+		force bool
+		path  string
+		want  string
+	}{
+		{name: "forced", force: true, path: "/about", want: "text/html; charset=utf-8"},
+		{name: "not forced", force: false, path: "/about", want: "application/octet-stream"},
+		{name: "requested directly", force: true, path: "/about.html", want: "application/octet-stream"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := newTestProxy(t, Config{ForceHtmlContentType: tc.force}, upstream)
+			rec := get(proxy, tc.path)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tc.want {
+				t.Errorf("Content-Type = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIndexPathFor(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{path: "", want: "/index.html"},
+		{path: "index", want: "/index.html"},
+		{path: "/", want: "/index.html"},
+		{path: "/about", want: "/index.html"},
+		{path: "/docs/", want: "/docs/index.html"},
+		{path: "/docs/intro", want: "/docs/index.html"},
+	} {
+		if got := indexPathFor(tc.path, "index.html"); got != tc.want {
+			t.Errorf("indexPathFor(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestResolveFallbacksPathologicalPaths(t *testing.T) {
+	for _, p := range []string{"", "index"} {
+		var tried []string
+		next := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			tried = append(tried, req.URL.Path)
+			if req.URL.Path == "/index.html" {
+				res.Write([]byte("root"))
+				return
+			}
+			http.NotFound(res, req)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = p
+		rec := httptest.NewRecorder()
+		ResolveFallbacks(FallbackOptions{})(next).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK || rec.Body.String() != "root" {
+			t.Errorf("path %q = %d %q after trying %q, want the root index document", p, rec.Code, rec.Body.String(), tried)
+		}
+	}
+}
+
+func TestFallbackUpstreamRequests(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		envs []string
+		want []string
+	}{
+		{path: "/x", want: []string{"/c/x", "/c/x.html", "/c/x/index.html", "/c/index.html"}},
+		{path: "/x/", want: []string{"/c/x/", "/c/x/index.html"}},
+		{path: "/x.html", want: []string{"/c/x.html", "/c/index.html"}},
+		{path: "/x/index.html", want: []string{"/c/x/index.html"}},
+		{path: "/x", envs: []string{"master", "staging"}, want: []string{
+			"/c/x", "/c/x.html", "/c/x/index.html", "/c/index.html",
+			"/c/master/x", "/c/master/x.html", "/c/master/x/index.html", "/c/master/index.html",
+			"/c/staging/x", "/c/staging/x.html", "/c/staging/x/index.html", "/c/staging/index.html",
+		}},
+		// A path already in an env isn't tried under it again.
+		{path: "/master/x/", envs: []string{"master"}, want: []string{"/c/master/x/", "/c/master/x/index.html"}},
+	} {
+		container := newFakeContainer(nil)
+		proxy := newTestProxy(t, Config{FallbackEnvs: tc.envs}, container)
+		if rec := get(proxy, tc.path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s with envs %q = %d, want 404", tc.path, tc.envs, rec.Code)
+		}
+
+		hits := container.hits()
+		for _, p := range tc.want {
+			if hits[p] != 1 {
+				t.Errorf("%s with envs %q requested %s %d times, want once", tc.path, tc.envs, p, hits[p])
+			}
+			delete(hits, p)
+		}
+		if len(hits) > 0 {
+			t.Errorf("%s with envs %q made unexpected upstream requests %v", tc.path, tc.envs, hits)
+		}
+	}
+}
+
+func TestHtmlFallbackUpstreamRequests(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/about.html": "about"})
+	proxy := newTestProxy(t, Config{}, container)
+
+	if rec := get(proxy, "/about"); rec.Code != http.StatusOK || rec.Body.String() != "about" {
+		t.Fatalf("/about = %d %q, want about.html", rec.Code, rec.Body.String())
+	}
+	// The miss, then the .html page, and nothing in between.
+	want := map[string]int{"/c/about": 1, "/c/about.html": 1}
+	if hits := container.hits(); !reflect.DeepEqual(hits, want) {
+		t.Errorf("/about made upstream requests %v, want %v", hits, want)
+	}
+}
+
+// x.html takes precedence over x/index.html when both exist.
+func TestHtmlFallbackPrecedence(t *testing.T) {
+	container := newFakeContainer(map[string]string{
+		"/c/docs.html":       "page",
+		"/c/docs/index.html": "directory",
+	})
+	proxy := newTestProxy(t, Config{}, container)
+
+	if rec := get(proxy, "/docs"); rec.Code != http.StatusOK || rec.Body.String() != "page" {
+		t.Errorf("/docs = %d %q, want docs.html", rec.Code, rec.Body.String())
+	}
+	if hits := container.hits(); hits["/c/docs/index.html"] != 0 {
+		t.Errorf("/docs requested /c/docs/index.html %d times, want none", hits["/c/docs/index.html"])
+	}
+	// The directory's index is still served for the directory itself.
+	if rec := get(proxy, "/docs/"); rec.Code != http.StatusOK || rec.Body.String() != "directory" {
+		t.Errorf("/docs/ = %d %q, want docs/index.html", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	// The upstream redirects each path to the location it names, in which
+	// BLOB stands for the blob host.
+	locations := map[string]string{
+		"/c/absolute": "http://BLOB/c/new/page?v=2",
+		"/c/relative": "/c/new/page",
+		"/c/root":     "http://BLOB/c",
+		"/c/external": "https://elsewhere.example.org/c/page",
+		"/c/outside":  "/other/page",
+	}
+	upstream := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		location, ok := locations[req.URL.Path]
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		http.Redirect(res, req, strings.Replace(location, "BLOB", req.Host, 1), http.StatusFound)
+	})
+	proxy := newTestProxy(t, Config{}, upstream)
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{path: "/absolute", want: "http://www.example.com/new/page?v=2"},
+		{path: "/relative", want: "http://www.example.com/new/page"},
+		{path: "/root", want: "http://www.example.com/"},
+		{path: "/external", want: "https://elsewhere.example.org/c/page"},
+		{path: "/outside", want: "/other/page"},
+	} {
+		rec := get(proxy, "http://www.example.com"+tc.path)
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != tc.want {
+			t.Errorf("%s = %d to %q, want a 302 to %q", tc.path, rec.Code, rec.Header().Get("Location"), tc.want)
+		}
+	}
+}
+
+// echoPath answers with the path the request reached it with.
+var echoPath = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+	res.Write([]byte(req.URL.Path))
+})
+
+func TestSubdomainAsSubpathErrors(t *testing.T) {
+	handler := SubdomainAsSubpath("example.com", "master", HostMismatchError, nil)(echoPath)
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{host: "example.org", want: "host example.org does not match base domain example.com"},
+		{host: "a.b.example.com", want: "host a.b.example.com has too many subdomains for base domain example.com"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", tc.host, rec.Code)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tc.want {
+			t.Errorf("%s body = %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestSubdomainAsSubpathRedirect(t *testing.T) {
+	redirectTo := &url.URL{Scheme: "https", Host: "www.example.com", Path: "/site"}
+	handler := SubdomainAsSubpath("example.com", "master", HostMismatchRedirect, redirectTo)(echoPath)
+
+	req := httptest.NewRequest(http.MethodGet, "/docs/page?tab=2", nil)
+	req.Host = "example.org"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://www.example.com/site/docs/page?tab=2" {
+		t.Errorf("example.org = %d to %q, want a 301 to https://www.example.com/site/docs/page?tab=2", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Hosts that map to an env are still served.
+	req = httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Host = "staging.example.com"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "/staging/page" {
+		t.Errorf("staging.example.com = %d %q, want /staging/page", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSubdomainAsSubpathDefaultEnv(t *testing.T) {
+	handler := SubdomainAsSubpath("example.com", "master", HostMismatchDefaultEnv, nil)(echoPath)
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{host: "example.org", want: "/master/page"},
+		{host: "a.b.example.com", want: "/master/page"},
+		{host: "staging.example.com", want: "/staging/page"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.want {
+			t.Errorf("%s = %d %q, want %q", tc.host, rec.Code, rec.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestHostMismatchRedirectNeedsTarget(t *testing.T) {
+	_, err := NewHandler(&Config{
+		AzureStorageAccount:   "account",
+		AzureStorageContainer: "c",
+		BaseDomain:            "example.com",
+		UseSubdomains:         true,
+		HostMismatchAction:    HostMismatchRedirect,
+		Logger:                discardLogger(),
+	})
+	if err == nil {
+		t.Error("redirecting mismatched hosts without HostRedirectTo was accepted")
+	}
+}
+
+func TestSubdomainPath(t *testing.T) {
+	for _, tc := range []struct {
+		host    string
+		domain  string
+		want    string
+		wantErr bool
+	}{
+		{host: "example.com", domain: "example.com", want: "/master/page"},
+		{host: "staging.example.com", domain: "example.com", want: "/staging/page"},
+		{host: "Staging.EXAMPLE.com", domain: "example.com", want: "/staging/page"},
+		{host: "staging.example.com", domain: "Example.COM", want: "/staging/page"},
+		{host: "staging.example.com:8080", domain: "example.com", want: "/staging/page"},
+		{host: "example.com:8080", domain: "example.com", want: "/master/page"},
+		{host: "localhost:3000", domain: "localhost", want: "/master/page"},
+		{host: "dev.localhost:3000", domain: "localhost", want: "/dev/page"},
+		{host: "[::1]:3000", domain: "::1", want: "/master/page"},
+		{host: "[::1]", domain: "::1", want: "/master/page"},
+		{host: "[::1]:3000", domain: "example.com", wantErr: true},
+		{host: "evilexample.com", domain: "example.com", wantErr: true},
+		{host: "staging.evilexample.com", domain: "example.com", wantErr: true},
+		{host: ".example.com", domain: "example.com", wantErr: true},
+		{host: "a.b.example.com", domain: "example.com", wantErr: true},
+	} {
+		got, err := subdomainPath(tc.host, "/page", tc.domain, "master")
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("subdomainPath(%q, %q) = %q, want an error", tc.host, tc.domain, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("subdomainPath(%q, %q) = %q, %v, want %q", tc.host, tc.domain, got, err, tc.want)
+		}
+	}
+}
+
+func TestCustomIndexDocument(t *testing.T) {
+	container := newFakeContainer(map[string]string{
+		"/c/docs/default.htm": "docs",
+		"/c/docs/index.html":  "wrong index",
+	})
+	proxy := newTestProxy(t, Config{IndexDocument: "default.htm"}, container)
+	for _, p := range []string{"/docs/", "/docs"} {
+		if rec := get(proxy, p); rec.Code != http.StatusOK || rec.Body.String() != "docs" {
+			t.Errorf("%s = %d %q, want 200 docs", p, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCacheAnswersMatchingETag(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/app.js": "app"})
+	proxy := newTestProxy(t, Config{CacheTTL: time.Hour}, container)
+
+	rec := get(proxy, "/app.js")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag != `"`+contentMd5Of("app")+`"` {
+		t.Fatalf("first request = %d with ETag %q, want 200 with the MD5 as ETag", rec.Code, etag)
+	}
+
+	for _, tc := range []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{ifNoneMatch: etag, want: http.StatusNotModified},
+		{ifNoneMatch: "W/" + etag, want: http.StatusNotModified},
+		{ifNoneMatch: `"other", ` + etag, want: http.StatusNotModified},
+		{ifNoneMatch: `"other"`, want: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+		req.Header.Set("If-None-Match", tc.ifNoneMatch)
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("If-None-Match %s = %d, want %d", tc.ifNoneMatch, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusNotModified && (rec.Body.Len() > 0 || rec.Header().Get("ETag") != etag) {
+			t.Errorf("304 had body %q and ETag %q, want no body and ETag %s", rec.Body.String(), rec.Header().Get("ETag"), etag)
+		}
+	}
+	if hits := container.hits(); hits["/c/app.js"] != 1 {
+		t.Errorf("upstream requests = %v, want only the first", hits)
+	}
+}
+
+// countingStore stores nothing, like NoopCache, and counts lookups.
+type countingStore struct {
+	NoopCache
+	gets atomic.Int64
+}
+
+func (s *countingStore) Get(ctx context.Context, method string, key string) (*CachedResponse, error) {
+	s.gets.Add(1)
+	return nil, nil
+}
+
+func TestCacheCoalescesConcurrentMisses(t *testing.T) {
+	const clients = 20
+	// Nothing is stored, so a request that missed the shared fetch would
+	// have to go upstream itself.
+	store := &countingStore{}
+	cache := NewMd5ResponseCache(CacheOptions{Store: store, Logger: discardLogger()}, http.DefaultClient)
+
+	var upstreamRequests atomic.Int64
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		upstreamRequests.Add(1)
+		<-release
+		res.Header().Set("Content-Md5", contentMd5Of("shared"))
+		res.Write([]byte("shared"))
+	})
+	handler := CacheResponses(&url.URL{Scheme: "http", Host: "blob", Path: "/c"}, cache)(upstream)
+
+	var wg sync.WaitGroup
+	bodies := make(chan string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page.html", nil))
+			bodies <- rec.Body.String()
+		}()
+	}
+
+	// Every client looks the path up twice, once per cache key, before
+	// joining the fetch.
+	for store.gets.Load() < 2*clients {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	if n := upstreamRequests.Load(); n != 1 {
+		t.Errorf("%d concurrent misses made %d upstream requests, want 1", clients, n)
+	}
+	for body := range bodies {
+		if body != "shared" {
+			t.Errorf("client got %q, want shared", body)
+		}
+	}
+}
+
+func TestBlobEndpointWithoutContainer(t *testing.T) {
+	upstream := httptest.NewServer(newFakeContainer(map[string]string{"/devstoreaccount1/web/master/index.html": "home"}))
+	defer upstream.Close()
+	endpoint, _ := url.Parse(upstream.URL + "/devstoreaccount1/web")
+	h, err := NewHandler(&Config{
+		BlobEndpoint: endpoint,
+		DefaultEnv:   "master",
+		Logger:       discardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.Target.String(), upstream.URL+"/devstoreaccount1/web"; got != want {
+		t.Errorf("Target = %s, want %s", got, want)
+	}
+	handler, err := h.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(handler, "/"); rec.Code != http.StatusOK || rec.Body.String() != "home" {
+		t.Errorf("GET / = %d %q, want 200 home", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlerMountsInAnotherServer(t *testing.T) {
+	upstream := httptest.NewServer(newFakeContainer(map[string]string{"/c/master/index.html": "home"}))
+	defer upstream.Close()
+	endpoint, _ := url.Parse(upstream.URL)
+	h, err := NewHandler(&Config{
+		AzureStorageContainer: "c",
+		BlobEndpoint:          endpoint,
+		BaseDomain:            "127.0.0.1",
+		DefaultEnv:            "master",
+		UseSubdomains:         true,
+		Logger:                discardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := h.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("api"))
+	})
+	mux.Handle("/", handler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{path: "/", want: "home"},
+		{path: "/api/", want: "api"},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tc.want {
+			t.Errorf("%s = %d %q, want 200 %q", tc.path, resp.StatusCode, body, tc.want)
+		}
+	}
+}
+
+func TestMaxFallbacks(t *testing.T) {
+	for _, tc := range []struct {
+		maxFallbacks int
+		want         int
+	}{
+		{maxFallbacks: 0, want: 4},
+		{maxFallbacks: 1, want: 2},
+		{maxFallbacks: 2, want: 3},
+	} {
+		container := newFakeContainer(nil)
+		proxy := newTestProxy(t, Config{MaxFallbacks: tc.maxFallbacks}, container)
+		if rec := get(proxy, "/missing"); rec.Code != http.StatusNotFound {
+			t.Errorf("MaxFallbacks %d answered %d, want 404", tc.maxFallbacks, rec.Code)
+		}
+		total := 0
+		for _, n := range container.hits() {
+			total += n
+		}
+		if total != tc.want {
+			t.Errorf("MaxFallbacks %d made %d upstream requests, want %d", tc.maxFallbacks, total, tc.want)
+		}
+	}
+}
+
+func TestSPAMode(t *testing.T) {
+	container := newFakeContainer(map[string]string{
+		"/c/master/index.html":  "master shell",
+		"/c/staging/index.html": "staging shell",
+	})
+	proxy := newTestProxy(t, Config{
+		BaseDomain:    "example.com",
+		DefaultEnv:    "master",
+		UseSubdomains: true,
+		SPAMode:       true,
+	}, container)
+	for _, tc := range []struct {
+		url  string
+		code int
+		body string
+	}{
+		{url: "http://example.com/users/42/settings", code: http.StatusOK, body: "master shell"},
+		{url: "http://staging.example.com/users/42", code: http.StatusOK, body: "staging shell"},
+		{url: "http://example.com/assets/missing.js", code: http.StatusNotFound},
+	} {
+		rec := get(proxy, tc.url)
+		if rec.Code != tc.code || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s = %d %q, want %d %q", tc.url, rec.Code, rec.Body.String(), tc.code, tc.body)
+		}
+	}
+}
+
+func TestCORSPreflightHeaders(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/main/app.js": "app"})
+	proxy := newTestProxy(t, Config{
+		BaseDomain:         "example.com",
+		DefaultEnv:         "main",
+		CORSAllowedHeaders: []string{"Authorization", "X-Requested-With"},
+		CORSExposedHeaders: []string{"Content-Md5", "ETag"},
+	}, container)
+
+	req := httptest.NewRequest(http.MethodOptions, "/app.js", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("preflight Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Authorization" {
+		t.Errorf("preflight Access-Control-Allow-Headers = %q, want Authorization", got)
+	}
+
+	// A header outside the configured list isn't allowed, since there's
+	// no wildcard unless one is configured.
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "" {
+		t.Errorf("preflight for an unlisted header got Access-Control-Allow-Headers %q, want none", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/app.js", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "Content-Md5, Etag" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want Content-Md5, Etag", got)
+	}
+}
+
+func TestListenH2C(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/index.html": "home"})
+	server := httptest.NewServer(container)
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "scproxy.sock")
+	h, err := NewHandler(&Config{
+		BlobEndpoint:          endpoint,
+		AzureStorageContainer: "c",
+		UnixSocket:            socket,
+		H2C:                   true,
+		Logger:                discardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ListenWithContext(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ListenWithContext = %v", err)
+		}
+	}()
+
+	// Prior knowledge h2c: HTTP/2 frames straight over the plain connection.
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		resp, err = client.Get("http://scproxy/index.html")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || string(body) != "home" {
+		t.Errorf("got %s %d %q, want HTTP/2.0 200 home", resp.Proto, resp.StatusCode, body)
+	}
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+	container := newFakeContainer(map[string]string{
+		"/c/docs/index.html": "docs",
+		"/c/about.html":      "about",
+	})
+	proxy := newTestProxy(t, Config{RedirectTrailingSlash: true}, container)
+
+	rec := get(proxy, "/docs?tab=2")
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/docs/?tab=2" {
+		t.Errorf("/docs = %d to %q, want a 301 to /docs/?tab=2", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := get(proxy, "/docs/"); rec.Code != http.StatusOK || rec.Body.String() != "docs" {
+		t.Errorf("/docs/ = %d %q, want the index document", rec.Code, rec.Body.String())
+	}
+	// Other fallbacks are still served in place.
+	if rec := get(proxy, "/about"); rec.Code != http.StatusOK || rec.Body.String() != "about" {
+		t.Errorf("/about = %d %q, want about.html", rec.Code, rec.Body.String())
+	}
+	if rec := get(proxy, "/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("/missing = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// Without the option the index document is served at /docs.
+	proxy = newTestProxy(t, Config{}, container)
+	if rec := get(proxy, "/docs"); rec.Code != http.StatusOK || rec.Body.String() != "docs" {
+		t.Errorf("/docs without RedirectTrailingSlash = %d %q, want the index document", rec.Code, rec.Body.String())
+	}
+}
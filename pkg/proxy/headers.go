@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// headerWriter passes a response through to the underlying writer without
+// buffering its body. The handler gets headers of its own, which rewrite
+// adjusts for the status right before they are added to the underlying
+// writer's, the same as a buffered writer's would be. Middleware that only
+// touch headers use it so they add no copy of the body.
+type headerWriter struct {
+	underlying  http.ResponseWriter
+	header      http.Header
+	rewrite     func(status int, header http.Header)
+	wroteHeader bool
+}
+
+// serveRewritingHeaders serves next through a headerWriter for res.
+func serveRewritingHeaders(res http.ResponseWriter, req *http.Request, next http.Handler, rewrite func(status int, header http.Header)) {
+	w := &headerWriter{underlying: res, header: make(http.Header), rewrite: rewrite}
+	next.ServeHTTP(w, req)
+	// A response without a body still gets its headers rewritten.
+	w.WriteHeader(http.StatusOK)
+}
+
+func (w *headerWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.rewrite(code, w.header)
+	for k, v := range w.header {
+		for _, s := range v {
+			w.underlying.Header().Add(k, s)
+		}
+	}
+	w.underlying.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(bytes []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.underlying.Write(bytes)
+}
+
+func (w *headerWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w.underlying).Flush()
+}
+
+func (w *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.wroteHeader = true
+	return http.NewResponseController(w.underlying).Hijack()
+}
+
+// HeaderRule sets and removes response headers for request paths matching
+// either Glob or Regex. A glob without a slash, like *.js, is matched against
+// the last path segment, otherwise against the whole path.
+type HeaderRule struct {
+	Glob   string            `mapstructure:"glob"`
+	Regex  string            `mapstructure:"regex"`
+	Set    map[string]string `mapstructure:"set"`
+	Remove []string          `mapstructure:"remove"`
+}
+
+type compiledHeaderRule struct {
+	HeaderRule
+	regex *regexp.Regexp
+}
+
+func compileHeaderRules(rules []HeaderRule) ([]compiledHeaderRule, error) {
+	var compiled []compiledHeaderRule
+	for i, rule := range rules {
+		if (rule.Glob == "") == (rule.Regex == "") {
+			return nil, fmt.Errorf("header rule %d must have exactly one of glob or regex", i)
+		}
+		c := compiledHeaderRule{HeaderRule: rule}
+		if rule.Glob != "" {
+			if _, err := path.Match(rule.Glob, ""); err != nil {
+				return nil, fmt.Errorf("header rule %d: invalid glob %q: %w", i, rule.Glob, err)
+			}
+		} else {
+			regex, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("header rule %d: invalid regex %q: %w", i, rule.Regex, err)
+			}
+			c.regex = regex
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func (r compiledHeaderRule) matches(p string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(p)
+	}
+	return globMatches(r.Glob, p)
+}
+
+// globMatches matches a glob without a slash against the last segment of p
+// and any other glob against the whole of p.
+func globMatches(glob string, p string) bool {
+	if !strings.Contains(glob, "/") {
+		p = path.Base(p)
+	}
+	matched, _ := path.Match(glob, p)
+	return matched
+}
+
+// RewriteHeaderRules applies each matching rule in order, so a later rule
+// can override an earlier one. Rules match the path the client requested,
+// before any subdomain or fallback rewriting, and only apply to successful
+// and 304 responses so errors and redirects never pick up long cache
+// lifetimes.
+func RewriteHeaderRules(rules []HeaderRule) (func(next http.Handler) http.Handler, error) {
+	compiled, err := compileHeaderRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			var matched []compiledHeaderRule
+			for _, rule := range compiled {
+				if rule.matches(req.URL.Path) {
+					matched = append(matched, rule)
+				}
+			}
+			if len(matched) == 0 {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			serveRewritingHeaders(res, req, next, func(status int, header http.Header) {
+				if status >= 300 && status != http.StatusNotModified {
+					return
+				}
+				for _, rule := range matched {
+					for _, name := range rule.Remove {
+						header.Del(name)
+					}
+					for name, value := range rule.Set {
+						header.Set(name, value)
+					}
+				}
+			})
+		})
+	}, nil
+}
+
+// DefaultCacheControl sets Cache-Control on successful and 304 responses that
+// don't have one, to html for HTML pages and to other for everything else.
+// An empty value leaves those responses alone.
+func DefaultCacheControl(html string, other string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			serveRewritingHeaders(res, req, next, func(status int, header http.Header) {
+				if (status >= 300 && status != http.StatusNotModified) || header.Get("Cache-Control") != "" {
+					return
+				}
+				value := other
+				if mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mediaType == "text/html" {
+					value = html
+				}
+				if value != "" {
+					header.Set("Cache-Control", value)
+				}
+			})
+		})
+	}
+}
+
+// ForceDownload sets Content-Disposition: attachment on successful responses
+// for paths with one of extensions, so browsers download them rather than
+// render them, under the last segment of the requested path as filename. A
+// redirect to blob storage can't carry the header, so the router proxies
+// redirected extensions that are forced downloads too.
+func ForceDownload(extensions []string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if !hasExtension(req.URL.Path, extensions) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			filename := path.Base(requestedURL(req).Path)
+			serveRewritingHeaders(res, req, next, func(status int, header http.Header) {
+				if status >= 300 && status != http.StatusNotModified {
+					return
+				}
+				// FormatMediaType quotes the name, and switches to the RFC
+				// 2231 form for names that aren't plain ASCII.
+				header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+			})
+		})
+	}
+}
+
+// hasExtension reports whether p ends in one of extensions, as normalized by
+// normalizeExtensions.
+func hasExtension(p string, extensions []string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
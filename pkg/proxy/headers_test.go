@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRewriteHeaderRules(t *testing.T) {
+	rules, err := RewriteHeaderRules([]HeaderRule{
+		{Glob: "*.js", Set: map[string]string{"Cache-Control": "public, max-age=31536000, immutable"}},
+		{Regex: `^/private/`, Remove: []string{"Cache-Control"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rules(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Cache-Control", "max-age=60")
+		if req.URL.Path == "/missing.js" {
+			http.NotFound(res, req)
+			return
+		}
+		res.Write([]byte("body"))
+	}))
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{path: "/assets/app.3f2a.js", want: "public, max-age=31536000, immutable"},
+		{path: "/index.html", want: "max-age=60"},
+		{path: "/app.json", want: "max-age=60"},
+		{path: "/missing.js", want: "max-age=60"},
+		{path: "/private/page.html", want: ""},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got := rec.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("%s Cache-Control = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteHeaderRulesInvalid(t *testing.T) {
+	for _, rule := range []HeaderRule{
+		{},
+		{Glob: "*.js", Regex: `\.js$`},
+		{Glob: "[", Set: map[string]string{"X": "y"}},
+		{Regex: "(", Set: map[string]string{"X": "y"}},
+	} {
+		if _, err := RewriteHeaderRules([]HeaderRule{rule}); err == nil {
+			t.Errorf("rule %+v was accepted, want an error", rule)
+		}
+	}
+}
+
+func TestDefaultCacheControl(t *testing.T) {
+	handler := DefaultCacheControl("no-cache", "public, max-age=3600")(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch path.Ext(req.URL.Path) {
+		case ".html":
+			res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		default:
+			res.Header().Set("Content-Type", "text/css")
+		}
+		if req.URL.Query().Has("cached") {
+			res.Header().Set("Cache-Control", "max-age=60")
+		}
+		if strings.HasPrefix(req.URL.Path, "/missing") {
+			res.WriteHeader(http.StatusNotFound)
+		}
+		res.Write([]byte("body"))
+	}))
+
+	for _, tc := range []struct {
+		target string
+		want   string
+	}{
+		{target: "/index.html", want: "no-cache"},
+		{target: "/app.css", want: "public, max-age=3600"},
+		{target: "/index.html?cached", want: "max-age=60"},
+		{target: "/app.css?cached", want: "max-age=60"},
+		{target: "/missing.css", want: ""},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if got := rec.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("%s Cache-Control = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
+
+// Middleware that only touch headers pass the body straight through, so it
+// has reached the client, headers rewritten, before the handler returns.
+func TestHeaderMiddlewareStreams(t *testing.T) {
+	rules, err := RewriteHeaderRules([]HeaderRule{{Glob: "*.zip", Set: map[string]string{"X-Rule": "yes"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		middleware func(next http.Handler) http.Handler
+		header     string
+		want       string
+	}{
+		{"StripUpstreamHeaders", StripUpstreamHeaders([]string{"x-ms-"}), "X-Ms-Request-Id", ""},
+		{"SecurityHeaders", SecurityHeaders(SecurityHeadersOptions{FrameOptions: "DENY"}), "X-Frame-Options", "DENY"},
+		{"DefaultCacheControl", DefaultCacheControl("no-cache", "public, max-age=3600"), "Cache-Control", "public, max-age=3600"},
+		{"RewriteHeaderRules", rules, "X-Rule", "yes"},
+		{"ForceDownload", ForceDownload([]string{".zip"}), "Content-Disposition", `attachment; filename=site.zip`},
+		{"OverrideContentTypes", OverrideContentTypes(map[string]string{".zip": "application/zip"}), "Content-Type", "application/zip"},
+	} {
+		rec := httptest.NewRecorder()
+		handler := tc.middleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("X-Ms-Request-Id", "abc")
+			res.Header().Set("Content-Type", "application/octet-stream")
+			res.Write([]byte("first chunk"))
+			if rec.Body.String() != "first chunk" || rec.Header().Get(tc.header) != tc.want {
+				t.Errorf("%s: client got %q with %s %q before the handler returned, want %q with %q",
+					tc.name, rec.Body.String(), tc.header, rec.Header().Get(tc.header), "first chunk", tc.want)
+			}
+		}))
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/site.zip", nil))
+	}
+}
+
+// A handler that writes nothing still gets its headers rewritten.
+func TestHeaderMiddlewareWithoutBody(t *testing.T) {
+	handler := SecurityHeaders(SecurityHeadersOptions{FrameOptions: "DENY"})(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("empty response = %d with X-Frame-Options %q, want 200 with DENY", rec.Code, rec.Header().Get("X-Frame-Options"))
+	}
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func writeJSON(res http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	err := json.NewEncoder(res).Encode(v)
+	if err != nil {
+		LoggerFromContext(req.Context()).Error("failed to write response", "err", err)
+	}
+}
+
+func HealthzHandler() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		writeJSON(res, req, http.StatusOK, healthResponse{Status: "ok"})
+	}
+}
+
+// ReadyzHandler reports 503 unless the container root answers a HEAD request.
+// Any non-5xx status counts as reachable, since the root is not itself a blob.
+func ReadyzHandler(target *url.URL, client *http.Client) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		status, err := CheckUrlExists(target, client)
+		if err != nil {
+			LoggerFromContext(req.Context()).Warn("readiness check failed", "url", target.String(), "err", err)
+			writeJSON(res, req, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+			return
+		}
+		if status >= 500 {
+			LoggerFromContext(req.Context()).Warn("readiness check failed", "url", target.String(), "status", status)
+			writeJSON(res, req, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: http.StatusText(status)})
+			return
+		}
+		writeJSON(res, req, http.StatusOK, healthResponse{Status: "ok"})
+	}
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// IPFilter answers 403 to clients outside allow or inside deny. An empty
+// allow list admits everyone not denied. The client address is the one
+// resolved by ForwardedHeaders, so X-Forwarded-For is only honored from
+// trusted proxies.
+func IPFilter(allow, deny []string) (func(next http.Handler) http.Handler, error) {
+	allowed, err := parseNetworks(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed CIDR: %w", err)
+	}
+	denied, err := parseNetworks(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denied CIDR: %w", err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if (len(allowed) > 0 && !networksContain(allowed, req.RemoteAddr)) || networksContain(denied, req.RemoteAddr) {
+				LoggerFromContext(req.Context()).Info("client address not allowed", "client", req.RemoteAddr, "url", req.URL.String())
+				http.Error(res, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}, nil
+}
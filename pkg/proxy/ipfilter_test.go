@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	filter, err := IPFilter([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := filter(echoPath)
+	for _, tc := range []struct {
+		remoteAddr string
+		want       int
+	}{
+		{remoteAddr: "10.2.3.4:5000", want: http.StatusOK},
+		{remoteAddr: "10.1.3.4:5000", want: http.StatusForbidden},
+		{remoteAddr: "192.0.2.7:5000", want: http.StatusOK},
+		{remoteAddr: "192.0.2.8:5000", want: http.StatusForbidden},
+		{remoteAddr: "[2001:db8::1]:5000", want: http.StatusOK},
+		{remoteAddr: "[2001:db9::1]:5000", want: http.StatusForbidden},
+		{remoteAddr: "not an address", want: http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s = %d, want %d", tc.remoteAddr, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestIPFilterInvalidCIDR(t *testing.T) {
+	if _, err := IPFilter([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("invalid allowed CIDR was accepted")
+	}
+	if _, err := IPFilter(nil, []string{"example.com"}); err == nil {
+		t.Error("invalid denied CIDR was accepted")
+	}
+}
+
+func TestIPFilterRestrictsOperationalRoutes(t *testing.T) {
+	proxy := newTestProxy(t, Config{
+		Debug:         true,
+		StatsEndpoint: true,
+		Metrics:       true,
+		AdminToken:    "token",
+		DenyCIDRs:     []string{"192.0.2.0/24"},
+	}, newFakeContainer(nil))
+	for _, tc := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{method: http.MethodGet, path: "/page", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/readyz", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/metrics", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/_scproxy/stats", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/_scproxy/config", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/_scproxy/explain?url=/page", want: http.StatusForbidden},
+		{method: http.MethodPost, path: "/_scproxy/purge", want: http.StatusForbidden},
+		{method: http.MethodPost, path: "/_scproxy/invalidate", want: http.StatusForbidden},
+		{method: http.MethodGet, path: "/healthz", want: http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+}
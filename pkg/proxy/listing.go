@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// containerAndPrefix splits target, as built by newTarget, into the URL of
+// its container and the blob name prefix that upstreamPrefix adds.
+func containerAndPrefix(target *url.URL, upstreamPrefix string) (*url.URL, string) {
+	container := *target
+	container.RawPath = ""
+	prefix := strings.Trim(upstreamPrefix, "/")
+	if prefix != "" {
+		container.Path = strings.TrimSuffix(container.Path, "/"+prefix)
+		prefix += "/"
+	}
+	return &container, prefix
+}
+
+type directoryEntry struct {
+	Name string
+	Href string
+	Size int64
+	Dir  bool
+}
+
+var directoryListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// directoryEntries turns blobs and dirs into entries named relative to
+// prefix, directories first. Links are relative and start with ./ so a name
+// with a colon isn't read as a URL scheme.
+func directoryEntries(blobs []BlobEntry, dirs []string, prefix string) []directoryEntry {
+	var entries []directoryEntry
+	for _, dir := range dirs {
+		name := strings.TrimSuffix(strings.TrimPrefix(dir, prefix), "/")
+		if name == "" {
+			continue
+		}
+		entries = append(entries, directoryEntry{Name: name + "/", Href: "./" + url.PathEscape(name) + "/", Dir: true})
+	}
+	for _, b := range blobs {
+		name := strings.TrimPrefix(b.Name, prefix)
+		if name == "" {
+			continue
+		}
+		entries = append(entries, directoryEntry{Name: name, Href: "./" + url.PathEscape(name), Size: b.Size})
+	}
+	return entries
+}
+
+// ListDirectories answers a GET or HEAD for a directory path that 404s, after
+// every fallback, with an HTML listing of the blobs under it from the List
+// Blobs API, which needs list permission on the container. At most limit
+// entries are listed. A directory without any blobs keeps its 404.
+func ListDirectories(target *url.URL, upstreamPrefix string, limit int, client *http.Client) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if !strings.HasSuffix(req.URL.Path, "/") || (req.Method != http.MethodGet && req.Method != http.MethodHead) || fallbacksBypassed(req) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			w := newBufferedWriter(res, req)
+			next.ServeHTTP(w, req)
+
+			if w.StatusCode == http.StatusNotFound && !w.Committed() {
+				container, prefix := containerAndPrefix(TargetFromContext(req.Context(), target), upstreamPrefix)
+				prefix += strings.TrimPrefix(req.URL.Path, "/")
+				blobs, dirs, err := listBlobs(req.Context(), container, prefix, "/", limit, client)
+				if err != nil {
+					LoggerFromContext(req.Context()).Warn("directory listing failed", "url", req.URL.String(), "err", err)
+				} else if entries := directoryEntries(blobs, dirs, prefix); len(entries) > 0 {
+					LoggerFromContext(req.Context()).Info("not found, serving directory listing", "url", req.URL.String(), "entries", len(entries))
+					if limit > 0 && len(blobs)+len(dirs) >= limit {
+						LoggerFromContext(req.Context()).Warn("directory listing truncated", "url", req.URL.String(), "limit", limit)
+					}
+					page := NewCachedResponseWriter()
+					page.Header().Set("Content-Type", "text/html; charset=utf-8")
+					page.WriteHeader(http.StatusOK)
+					err = directoryListingTemplate.Execute(page, struct {
+						Path    string
+						Entries []directoryEntry
+					}{requestedURL(req).Path, entries})
+					if err != nil {
+						LoggerFromContext(req.Context()).Error("failed to render directory listing", "err", err)
+					} else {
+						w = page
+					}
+				}
+			}
+
+			err := w.WriteTo(res)
+			if err != nil {
+				res.WriteHeader(500)
+				LoggerFromContext(req.Context()).Error("failed to write response", "err", err)
+			}
+		})
+	}
+}
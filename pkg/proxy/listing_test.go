@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const docsListXML = `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults ServiceEndpoint="https://account.blob.core.windows.net/" ContainerName="c">
+  <Prefix>docs/</Prefix>
+  <Delimiter>/</Delimiter>
+  <Blobs>
+    <Blob>
+      <Name>docs/guide.pdf</Name>
+      <Properties>
+        <Last-Modified>Mon, 01 Jan 2024 00:00:00 GMT</Last-Modified>
+        <Content-Length>1234</Content-Length>
+      </Properties>
+    </Blob>
+    <Blob>
+      <Name>docs/a b.txt</Name>
+      <Properties>
+        <Content-Length>5</Content-Length>
+      </Properties>
+    </Blob>
+    <BlobPrefix>
+      <Name>docs/images/</Name>
+    </BlobPrefix>
+  </Blobs>
+  <NextMarker />
+</EnumerationResults>`
+
+const emptyListXML = `<?xml version="1.0" encoding="utf-8"?>
+<EnumerationResults><Blobs /><NextMarker /></EnumerationResults>`
+
+func TestListDirectories(t *testing.T) {
+	var listed []string
+	upstream := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("comp") != "list" {
+			http.NotFound(res, req)
+			return
+		}
+		if req.URL.Path != "/c" || query.Get("restype") != "container" || query.Get("delimiter") != "/" {
+			t.Errorf("listed %s, want the container with a / delimiter", req.URL)
+		}
+		listed = append(listed, query.Get("prefix"))
+		res.Header().Set("Content-Type", "application/xml")
+		if query.Get("prefix") == "docs/" {
+			res.Write([]byte(docsListXML))
+		} else {
+			res.Write([]byte(emptyListXML))
+		}
+	})
+	proxy := newTestProxy(t, Config{DirectoryListing: true}, upstream)
+
+	rec := get(proxy, "/docs/")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("/docs/ = %d %s, want an HTML listing", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"<title>Index of /docs/</title>",
+		`<a href="../">../</a>`,
+		`<a href="./images/">images/</a>`,
+		`<a href="./guide.pdf">guide.pdf</a></td><td>1234</td>`,
+		`<a href="./a%20b.txt">a b.txt</a></td><td>5</td>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing doesn't contain %s:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(strings.Join(listed, ","), "docs/") {
+		t.Errorf("listed prefixes %q, want docs/", listed)
+	}
+
+	// A directory without blobs and a file path keep their 404.
+	if rec := get(proxy, "/empty/"); rec.Code != http.StatusNotFound {
+		t.Errorf("/empty/ = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	listed = nil
+	if rec := get(proxy, "/docs/missing.txt"); rec.Code != http.StatusNotFound || len(listed) > 0 {
+		t.Errorf("/docs/missing.txt = %d after listing %q, want a 404 without a listing", rec.Code, listed)
+	}
+}
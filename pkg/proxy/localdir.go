@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// LocalFileServer serves files under dir the way blob storage serves blobs.
+// Only regular files exist, so a directory is a 404 rather than a listing or
+// a redirect to add a trailing slash, which leaves resolving it to the
+// fallback middleware. http.FileServer isn't used for the same reason: it
+// redirects requests for index.html to the directory.
+func LocalFileServer(dir string) http.Handler {
+	root := http.Dir(dir)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		f, err := root.Open(req.URL.Path)
+		if err != nil {
+			http.NotFound(res, req)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(res, req)
+			return
+		}
+
+		LoggerFromContext(req.Context()).Debug("serving local file", "path", req.URL.Path)
+		http.ServeContent(res, req, info.Name(), info.ModTime(), f)
+	})
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AllowMethods answers 405 to requests with a method outside methods, so
+// writes never reach blob storage, where a SAS token with write permissions
+// would let clients modify the container. CORS preflights are let through
+// whatever the methods, for AnswerOptions to answer.
+func AllowMethods(methods []string) func(next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	var names []string
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		if !allowed[method] {
+			allowed[method] = true
+			names = append(names, method)
+		}
+	}
+	allow := strings.Join(names, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if !allowed[req.Method] && !isPreflight(req) {
+				LoggerFromContext(req.Context()).Info("method not allowed", "method", req.Method, "url", req.URL.String())
+				res.Header().Set("Allow", allow)
+				http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+// AnswerOptions answers every OPTIONS request with a 204, so neither CORS
+// preflights nor plain OPTIONS requests reach the fallbacks, the cache or
+// blob storage. It goes after the CORS middleware, which sets the preflight
+// headers and passes the request on. The Allow header lists methods, and is
+// left out when methods is empty and any method is allowed.
+func AnswerOptions(methods []string) func(next http.Handler) http.Handler {
+	var names []string
+	seen := map[string]bool{}
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		if !seen[method] {
+			seen[method] = true
+			names = append(names, method)
+		}
+	}
+	allow := strings.Join(names, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodOptions {
+				next.ServeHTTP(res, req)
+				return
+			}
+			if allow != "" && !isPreflight(req) {
+				res.Header().Set("Allow", allow)
+			}
+			res.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowMethods(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/index.html": "home"})
+	proxy := newTestProxy(t, Config{}, container)
+
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(method, "/index.html", strings.NewReader("overwritten")))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s = %d, want %d", method, rec.Code, http.StatusMethodNotAllowed)
+		}
+		if got := rec.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+			t.Errorf("%s Allow = %q, want GET, HEAD, OPTIONS", method, got)
+		}
+	}
+	if hits := container.hits(); len(hits) != 0 {
+		t.Errorf("disallowed methods reached blob storage: %v", hits)
+	}
+
+	if rec := get(proxy, "/index.html"); rec.Code != http.StatusOK {
+		t.Errorf("GET = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAllowMethodsAnyMethod(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/index.html": "home"})
+	proxy := newTestProxy(t, Config{AllowedMethods: []string{}}, container)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/index.html", nil))
+	if rec.Code == http.StatusMethodNotAllowed {
+		t.Error("PUT got a 405 with every method allowed")
+	}
+}
+
+func TestAnswerOptions(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/index.html": "home"})
+	proxy := newTestProxy(t, Config{BaseDomain: "example.com", SPAMode: true}, container)
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/app/route", nil)
+	preflight.Header.Set("Origin", "https://app.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	plain := httptest.NewRequest(http.MethodOptions, "/index.html", nil)
+
+	for _, tc := range []struct {
+		name  string
+		req   *http.Request
+		allow string
+		cors  string
+	}{
+		{name: "preflight", req: preflight, cors: "https://app.example.com"},
+		{name: "plain", req: plain, allow: "GET, HEAD, OPTIONS"},
+	} {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, tc.req)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("%s OPTIONS = %d, want %d", tc.name, rec.Code, http.StatusNoContent)
+		}
+		if got := rec.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s OPTIONS Allow = %q, want %q", tc.name, got, tc.allow)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tc.cors {
+			t.Errorf("%s OPTIONS Access-Control-Allow-Origin = %q, want %q", tc.name, got, tc.cors)
+		}
+		if hits := container.hits(); len(hits) != 0 {
+			t.Errorf("%s OPTIONS made upstream requests %v, want none", tc.name, hits)
+		}
+	}
+}
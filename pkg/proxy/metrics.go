@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The collectors are always updated but only exposed when metrics are enabled.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scproxy_http_requests_total",
+		Help: "Total proxied requests by status code and method.",
+	}, []string{"code", "method"})
+
+	cacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scproxy_cache_lookups_total",
+		Help: "MD5 cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	fallbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scproxy_fallbacks_total",
+		Help: "Fallback retries after a 404, by fallback middleware.",
+	}, []string{"fallback"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "scproxy_upstream_request_duration_seconds",
+		Help:    "Latency of requests to blob storage.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"code", "method"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		requestsTotal,
+		cacheLookupsTotal,
+		fallbacksTotal,
+		upstreamDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+const (
+	fallbackHtml          = "html"
+	fallbackTrailingSlash = "trailing_slash"
+	fallbackIndex         = "index"
+	fallbackDefaultEnv    = "default_env"
+	fallbackSPA           = "spa"
+)
+
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+func CountRequests() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return promhttp.InstrumentHandlerCounter(requestsTotal, next)
+	}
+}
+
+func instrumentRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return promhttp.InstrumentRoundTripperDuration(upstreamDuration, next)
+}
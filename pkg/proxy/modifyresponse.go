@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strconv"
+)
+
+// modifyResponseError marks an error returned by Config.ModifyResponse, so
+// proxyErrorHandler doesn't report it as blob storage being unreachable.
+type modifyResponseError struct {
+	err error
+}
+
+func (e *modifyResponseError) Error() string {
+	return "modifying upstream response: " + e.err.Error()
+}
+
+func (e *modifyResponseError) Unwrap() error {
+	return e.err
+}
+
+// withResponseModifier runs modify on every upstream response after the
+// proxy's own adjustments.
+func withResponseModifier(proxy *httputil.ReverseProxy, modify func(*http.Response) error) {
+	adjust := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if adjust != nil {
+			if err := adjust(resp); err != nil {
+				return err
+			}
+		}
+		if err := modify(resp); err != nil {
+			return &modifyResponseError{err: err}
+		}
+		return nil
+	}
+}
+
+// RewriteHrefOrigins is a Config.ModifyResponse hook that replaces the
+// origin from, e.g. https://staging.example.com, with to in the href
+// attributes of HTML responses. It also serves as an example of a hook that
+// rewrites bodies: responses with a Content-Encoding are left alone, and
+// since the body no longer matches its Content-MD5, that header is dropped
+// and the cache falls back to the ETag.
+func RewriteHrefOrigins(from string, to string) func(*http.Response) error {
+	href := regexp.MustCompile(`(?i)(\shref\s*=\s*["']?)` + regexp.QuoteMeta(from))
+	replacement := []byte("${1}" + to)
+	return func(resp *http.Response) error {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if mediaType != "text/html" || resp.Header.Get("Content-Encoding") != "" {
+			return nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = href.ReplaceAll(body, replacement)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.Header.Del("Content-Md5")
+		return nil
+	}
+}
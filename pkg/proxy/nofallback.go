@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+type noFallbackContextKey struct{}
+
+// BypassFallbacks sends requests for paths matching any of globs straight to
+// blob storage, skipping ResolveFallbacks and ServeCustomErrorPage, for files
+// like /config.json whose clients expect a plain 404 when they are missing.
+// Globs match the path the client requested the way HeaderRule globs do.
+func BypassFallbacks(globs []string) (func(next http.Handler) http.Handler, error) {
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid no-fallback glob %q: %w", glob, err)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if matchesAnyGlob(globs, req.URL.Path) {
+				req = req.WithContext(context.WithValue(req.Context(), noFallbackContextKey{}, true))
+			}
+			next.ServeHTTP(res, req)
+		})
+	}, nil
+}
+
+func fallbacksBypassed(req *http.Request) bool {
+	bypassed, _ := req.Context().Value(noFallbackContextKey{}).(bool)
+	return bypassed
+}
+
+func matchesAnyGlob(globs []string, p string) bool {
+	for _, glob := range globs {
+		if globMatches(glob, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBypassFallbacks(t *testing.T) {
+	container := newFakeContainer(map[string]string{"/c/index.html": "home"})
+	proxy := newTestProxy(t, Config{
+		NoFallbackPaths: []string{"config.json", "/api/*"},
+		NotFoundPage:    "/index.html",
+	}, container)
+	for _, tc := range []struct {
+		path string
+		want map[string]int
+	}{
+		{path: "/config.json", want: map[string]int{"/c/config.json": 1}},
+		{path: "/app/config.json", want: map[string]int{"/c/app/config.json": 1}},
+		{path: "/api/users", want: map[string]int{"/c/api/users": 1}},
+	} {
+		rec := get(proxy, tc.path)
+		if rec.Code != http.StatusNotFound || rec.Body.String() == "home" {
+			t.Errorf("%s = %d %q, want blob storage's 404", tc.path, rec.Code, rec.Body.String())
+		}
+		if hits := container.hits(); !reflect.DeepEqual(hits, tc.want) {
+			t.Errorf("%s made upstream requests %v, want %v", tc.path, hits, tc.want)
+		}
+	}
+
+	// Paths that don't match still fall back.
+	if rec := get(proxy, "/other.json"); rec.Code != http.StatusOK || rec.Body.String() != "home" {
+		t.Errorf("/other.json = %d %q, want the index document", rec.Code, rec.Body.String())
+	}
+}
+
+func TestBypassFallbacksInvalidGlob(t *testing.T) {
+	if _, err := BypassFallbacks([]string{"["}); err == nil {
+		t.Error("invalid glob was accepted")
+	}
+}
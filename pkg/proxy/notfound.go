@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"container/list"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultNotFoundCacheMaxEntries = 10000
+
+type notFoundEntry struct {
+	key     string
+	value   *CachedResponseWriter
+	expires time.Time
+	element *list.Element
+}
+
+// NotFoundCache remembers paths that 404'd after every fallback, so repeated
+// requests for them don't rerun the fallbacks against blob storage. Entries
+// are never revalidated, so ttl bounds how long a newly deployed path can
+// keep answering 404.
+type NotFoundCache struct {
+	mu sync.Mutex
+
+	entries    map[string]*notFoundEntry
+	ttl        time.Duration
+	maxEntries int
+
+	// lru orders entries from most (front) to least (back) recently used.
+	lru *list.List
+}
+
+func NewNotFoundCache(ttl time.Duration, maxEntries int) *NotFoundCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultNotFoundCacheMaxEntries
+	}
+	return &NotFoundCache{
+		entries:    make(map[string]*notFoundEntry),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+	}
+}
+
+func (c *NotFoundCache) get(key string) *CachedResponseWriter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entries[key]
+	if e == nil {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e.element)
+	return e.value
+}
+
+func (c *NotFoundCache) put(key string, w *CachedResponseWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old := c.entries[key]; old != nil {
+		c.remove(old)
+	}
+	e := &notFoundEntry{key: key, value: w, expires: time.Now().Add(c.ttl)}
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back().Value.(*notFoundEntry))
+	}
+}
+
+// PurgeAll forgets every remembered 404 and returns how many were dropped.
+func (c *NotFoundCache) PurgeAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := c.lru.Len()
+	c.entries = make(map[string]*notFoundEntry)
+	c.lru.Init()
+	return purged
+}
+
+func (c *NotFoundCache) remove(e *notFoundEntry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.key)
+}
+
+// CacheNotFound serves GET and HEAD requests from cache when the same path
+// resolved to a 404 within ttl. It belongs above the fallbacks so it records
+// their final answer rather than the first miss.
+func CacheNotFound(defaultTarget *url.URL, ttl time.Duration, maxEntries int) func(next http.Handler) http.Handler {
+	return CacheNotFoundIn(defaultTarget, NewNotFoundCache(ttl, maxEntries))
+}
+
+// CacheNotFoundIn is CacheNotFound with a cache the caller keeps to purge.
+func CacheNotFoundIn(defaultTarget *url.URL, cache *NotFoundCache) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			target := TargetFromContext(req.Context(), defaultTarget)
+			upstream := &url.URL{}
+			*upstream = *target
+			upstream.Path, upstream.RawPath = joinURLPath(target, req.URL)
+			upstream.RawQuery = joinURLQuery(target, req.URL)
+			key := req.Method + " " + upstream.String()
+
+			if cached := cache.get(key); cached != nil {
+				recordCacheResult(req, "not_found_hit")
+				LoggerFromContext(req.Context()).Debug("serving cached not found", "url", req.URL.String())
+				cached.WriteTo(res)
+				return
+			}
+
+			w := newBufferedWriter(res, req)
+			next.ServeHTTP(w, req)
+			if w.StatusCode == http.StatusNotFound && !w.Committed() {
+				cache.put(key, w)
+			}
+
+			err := w.WriteTo(res)
+			if err != nil {
+				res.WriteHeader(500)
+				LoggerFromContext(req.Context()).Error("failed to write response", "err", err)
+			}
+		})
+	}
+}
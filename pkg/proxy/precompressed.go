@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// precompressedVariants are tried in order of preference.
+var precompressedVariants = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptedEncodings returns the codings in an Accept-Encoding header that the
+// client hasn't refused with q=0.
+func acceptedEncodings(header string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, e := range strings.Split(header, ",") {
+		params := strings.Split(e, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		refused := false
+		for _, p := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if q, err := strconv.ParseFloat(value, 64); strings.EqualFold(name, "q") && err == nil && q == 0 {
+				refused = true
+			}
+		}
+		if coding != "" && !refused {
+			accepted[coding] = true
+		}
+	}
+	return accepted
+}
+
+// ServePrecompressed serves a file's .br or .gz sibling from blob storage when
+// the client accepts that encoding, falling back to the file itself. The
+// variant keeps the original file's content type, and since Content-Encoding
+// is already set, middleware.Compress leaves it alone.
+func ServePrecompressed(defaultTarget *url.URL) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			ext := filepath.Ext(req.URL.Path)
+			if (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Header.Get("Range") != "" ||
+				ext == "" || ext == ".br" || ext == ".gz" {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+			for _, variant := range precompressedVariants {
+				if !accepted[variant.encoding] {
+					continue
+				}
+
+				variantReq := req.Clone(req.Context())
+				variantReq.URL.RawPath = ""
+				variantReq.URL.Path = req.URL.Path + variant.extension
+				variantReq.Header.Del("Accept-Encoding")
+
+				w := newBufferedWriter(res, req)
+				encoding := variant.encoding
+				w.RewriteHeaders(func(header http.Header) {
+					if w.StatusCode != http.StatusOK {
+						return
+					}
+					header.Set("Content-Encoding", encoding)
+					header.Add("Vary", "Accept-Encoding")
+					if contentType := mime.TypeByExtension(ext); contentType != "" {
+						header.Set("Content-Type", contentType)
+					}
+				})
+				next.ServeHTTP(w, variantReq)
+
+				if w.StatusCode == http.StatusOK || w.Committed() {
+					target := TargetFromContext(req.Context(), defaultTarget)
+					LoggerFromContext(req.Context()).Debug("serving precompressed variant", "url", req.URL.String(), "variant", target.Path+variantReq.URL.Path)
+					err := w.WriteTo(res)
+					if err != nil {
+						res.WriteHeader(500)
+						LoggerFromContext(req.Context()).Error("failed to write response", "err", err)
+					}
+					return
+				}
+			}
+
+			res.Header().Add("Vary", "Accept-Encoding")
+			next.ServeHTTP(res, req)
+		})
+	}
+}
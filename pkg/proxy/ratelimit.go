@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client IP. A bucket that has been idle
+// long enough to refill completely is indistinguishable from a new one, so
+// the sweep drops those to keep memory bounded by the active clients.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	rps     float64
+	burst   float64
+}
+
+// newRateLimiter returns a limiter whose sweep runs until ctx is done.
+func newRateLimiter(ctx context.Context, rps float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rps)))
+	}
+	l := &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rps:     rps,
+		burst:   float64(burst),
+	}
+	go l.sweep(ctx, rateLimitSweepInterval)
+	return l
+}
+
+// take spends a token for ip, or reports how long until one is available.
+func (l *rateLimiter) take(ip string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[ip]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rps)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rps * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.dropIdle(now)
+		}
+	}
+}
+
+// dropIdle drops the buckets that have refilled completely by now.
+func (l *rateLimiter) dropIdle(now time.Time) {
+	idle := time.Duration(l.burst / l.rps * float64(time.Second))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) > idle {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// RateLimit allows each client IP rps requests per second with bursts of up
+// to burst, answering 429 with Retry-After beyond that. A burst of zero
+// defaults to rps rounded up. The client IP is the one resolved by
+// ForwardedHeaders. Idle clients are swept from memory until ctx is done.
+func RateLimit(ctx context.Context, rps float64, burst int) func(next http.Handler) http.Handler {
+	limiter := newRateLimiter(ctx, rps, burst)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			ip, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				ip = req.RemoteAddr
+			}
+			ok, wait := limiter.take(ip)
+			if !ok {
+				LoggerFromContext(req.Context()).Info("rate limit exceeded", "client", ip, "url", req.URL.String())
+				res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(res, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := RateLimit(ctx, 1, 2)(echoPath)
+
+	for i, tc := range []struct {
+		remoteAddr string
+		want       int
+	}{
+		{remoteAddr: "192.0.2.1:5000", want: http.StatusOK},
+		{remoteAddr: "192.0.2.1:5001", want: http.StatusOK},
+		{remoteAddr: "192.0.2.1:5002", want: http.StatusTooManyRequests},
+		// Other clients have buckets of their own.
+		{remoteAddr: "192.0.2.2:5000", want: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("request %d from %s = %d, want %d", i, tc.remoteAddr, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("Retry-After = %q, want 1", rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Buckets refill within a millisecond.
+	l := newRateLimiter(ctx, 1000, 1)
+	l.take("192.0.2.1")
+
+	done := make(chan struct{})
+	go func() {
+		l.sweep(ctx, time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		n := len(l.buckets)
+		l.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle bucket was never swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sweep kept running after its context was done")
+	}
+}
+
+func TestRateLimitRestrictsOperationalRoutes(t *testing.T) {
+	proxy := newTestProxy(t, Config{Debug: true, RateLimitRPS: 0.001, RateLimitBurst: 1}, newFakeContainer(nil))
+	if rec := get(proxy, "/page"); rec.Code != http.StatusNotFound {
+		t.Fatalf("first request = %d, want 404", rec.Code)
+	}
+	for _, p := range []string{"/_scproxy/config", "/readyz"} {
+		if rec := get(proxy, p); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("%s after the burst = %d, want 429", p, rec.Code)
+		}
+	}
+	if rec := get(proxy, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("/healthz after the burst = %d, want 200", rec.Code)
+	}
+}
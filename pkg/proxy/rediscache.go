@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache stores cache entries in Redis, so that replicas share one cache
+// and an entry is fetched and revalidated once rather than per replica. Each
+// entry is a hash under prefix that expires ttl after it was last stored or
+// revalidated. Eviction beyond that is left to Redis' maxmemory policy.
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func NewRedisCache(client *redis.Client, prefix string, ttl time.Duration) *RedisCache {
+	return &RedisCache{client: client, prefix: prefix, ttl: ttl}
+}
+
+// touchScript updates checked only if the entry still exists, so a Touch
+// racing a purge doesn't leave a hash without a body behind.
+var touchScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HSET", KEYS[1], "checked", ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+func (c *RedisCache) redisKey(method string, key string) string {
+	return c.prefix + entryKey(method, key)
+}
+
+func (c *RedisCache) Get(ctx context.Context, method string, key string) (*CachedResponse, error) {
+	fields, err := c.client.HGetAll(ctx, c.redisKey(method, key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if fields["meta"] == "" {
+		return nil, nil
+	}
+
+	var meta entryMeta
+	if err := json.Unmarshal([]byte(fields["meta"]), &meta); err != nil {
+		return nil, fmt.Errorf("decoding cache entry: %w", err)
+	}
+	checked, err := strconv.ParseInt(fields["checked"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("decoding cache entry: %w", err)
+	}
+	return meta.entry(time.Unix(0, checked), []byte(fields["body"]), []byte(fields["gzipped"]))
+}
+
+func (c *RedisCache) Put(ctx context.Context, r *CachedResponse) error {
+	meta, err := json.Marshal(newEntryMeta(r))
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{
+		"meta":    meta,
+		"checked": strconv.FormatInt(r.checked.UnixNano(), 10),
+		"body":    r.value.Buffer.Bytes(),
+	}
+	if r.gzipped != nil {
+		fields["gzipped"] = r.gzipped.Buffer.Bytes()
+	}
+
+	key := c.redisKey(r.method, r.key)
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, fields)
+		pipe.PExpire(ctx, key, c.ttl)
+		return nil
+	})
+	return err
+}
+
+func (c *RedisCache) Touch(ctx context.Context, r *CachedResponse) error {
+	key := c.redisKey(r.method, r.key)
+	return touchScript.Run(ctx, c.client, []string{key}, strconv.FormatInt(r.checked.UnixNano(), 10), c.ttl.Milliseconds()).Err()
+}
+
+// Delete drops the entry under r's key, even if another replica has stored
+// a newer one since, which at worst costs that replica a refetch.
+func (c *RedisCache) Delete(ctx context.Context, r *CachedResponse) error {
+	return c.client.Del(ctx, c.redisKey(r.method, r.key)).Err()
+}
+
+// Purge scans every entry for method to find the ones to drop, which is
+// fine for the occasional admin request it serves.
+func (c *RedisCache) Purge(ctx context.Context, method string, path string) (int, error) {
+	escaped := (&url.URL{Path: path}).EscapedPath()
+	purged := 0
+	err := c.scan(ctx, c.redisKey(method, ""), func(key string) error {
+		meta, err := c.client.HGet(ctx, key, "meta").Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var m entryMeta
+		if err := json.Unmarshal([]byte(meta), &m); err != nil {
+			return fmt.Errorf("decoding cache entry: %w", err)
+		}
+		r, err := m.entry(time.Time{}, nil, nil)
+		if err != nil {
+			return err
+		}
+		if !purgeMatches(r, method, path, escaped) {
+			return nil
+		}
+		n, err := c.client.Del(ctx, key).Result()
+		purged += int(n)
+		return err
+	})
+	return purged, err
+}
+
+func (c *RedisCache) PurgeAll(ctx context.Context) (int, error) {
+	purged := 0
+	err := c.scan(ctx, c.prefix, func(key string) error {
+		n, err := c.client.Del(ctx, key).Result()
+		purged += int(n)
+		return err
+	})
+	return purged, err
+}
+
+// scan calls fn for every key starting with prefix.
+func (c *RedisCache) scan(ctx context.Context, prefix string, fn func(key string) error) error {
+	iter := c.client.Scan(ctx, 0, escapeRedisPattern(prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// escapeRedisPattern escapes the glob characters SCAN's MATCH interprets.
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// etagBlob answers conditional GETs for the current body with a 304, like
+// blob storage does for the ETag the cache gives a blob from its MD5.
+type etagBlob struct {
+	mu   sync.Mutex
+	body string
+}
+
+func (b *etagBlob) set(body string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.body = body
+}
+
+func (b *etagBlob) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	resp := blobResponse(req, b.body)
+	if req.Header.Get("If-None-Match") == `"`+contentMd5Of(b.body)+`"` {
+		resp.StatusCode = http.StatusNotModified
+	}
+	return resp, nil
+}
+
+func newRedisResponseCache(t *testing.T, server *miniredis.Miniredis, lifetime time.Duration, upstream http.RoundTripper) *ResponseCache {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewMd5ResponseCache(CacheOptions{
+		EntryLifetime: lifetime,
+		Logger:        discardLogger(),
+		Store:         NewRedisCache(client, "scproxy:", time.Minute),
+	}, &http.Client{Transport: upstream})
+}
+
+func TestRedisCacheSharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	upstream := &etagBlob{body: "hello"}
+	first := newRedisResponseCache(t, server, time.Hour, upstream)
+	second := newRedisResponseCache(t, server, time.Hour, upstream)
+	ctx := context.Background()
+	target := &url.URL{Path: "/c/app.js"}
+
+	first.put(ctx, http.MethodGet, target, target, "", bufferedBlob("hello"))
+	w := second.get(ctx, http.MethodGet, target, "")
+	if w == nil {
+		t.Fatal("entry stored by one replica was not found by another")
+	}
+	if w.Buffer.String() != "hello" || w.Header().Get("Content-Type") != "text/plain" || w.StatusCode != http.StatusOK {
+		t.Errorf("shared entry = %d %s %q, want 200 text/plain hello", w.StatusCode, w.Header().Get("Content-Type"), w.Buffer.String())
+	}
+
+	keys := server.Keys()
+	if len(keys) != 1 || keys[0] != "scproxy:"+entryKey(http.MethodGet, cacheKey(target, "")) {
+		t.Fatalf("redis keys = %q, want one entry under the prefix", keys)
+	}
+	if ttl := server.TTL(keys[0]); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("entry TTL = %s, want at most a minute", ttl)
+	}
+	server.FastForward(time.Minute + time.Second)
+	if second.get(ctx, http.MethodGet, target, "") != nil {
+		t.Error("entry was served after its TTL")
+	}
+}
+
+func TestRedisCacheRevalidation(t *testing.T) {
+	server := miniredis.RunT(t)
+	upstream := &etagBlob{body: "v1"}
+	// With no lifetime every lookup revalidates.
+	cache := newRedisResponseCache(t, server, 0, upstream)
+	ctx := context.Background()
+	target := &url.URL{Path: "/c/app.js"}
+	key := "scproxy:" + entryKey(http.MethodGet, cacheKey(target, ""))
+
+	cache.put(ctx, http.MethodGet, target, target, "", bufferedBlob("v1"))
+	stored := server.HGet(key, "checked")
+	time.Sleep(time.Millisecond)
+	if w := cache.get(ctx, http.MethodGet, target, ""); w == nil || w.Buffer.String() != "v1" {
+		t.Fatal("unchanged blob was not served from the cache")
+	}
+	if touched := server.HGet(key, "checked"); touched == stored {
+		t.Error("revalidating an unchanged blob didn't update when it was checked")
+	}
+
+	upstream.set("v2")
+	if w := cache.get(ctx, http.MethodGet, target, ""); w != nil {
+		t.Errorf("changed blob was served from the cache as %q", w.Buffer.String())
+	}
+	if server.Exists(key) {
+		t.Error("entry for a changed blob was kept")
+	}
+}
+
+func TestRedisCachePurge(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := newRedisResponseCache(t, server, time.Hour, &etagBlob{})
+	ctx := context.Background()
+	for _, p := range []string{"/c/a.js", "/c/b.js", "/c/b.js?v=2"} {
+		target, err := url.Parse(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.put(ctx, http.MethodGet, target, target, "", bufferedBlob(p))
+	}
+	// Keys outside the prefix, with glob characters in them too, are left
+	// alone.
+	server.Set("scproxy*other", "x")
+	server.Set("unrelated", "x")
+
+	if n, err := cache.Purge(ctx, http.MethodGet, "/c/b.js"); err != nil || n != 2 {
+		t.Errorf("Purge(/c/b.js) = %d, %v, want 2 entries", n, err)
+	}
+	if n, err := cache.PurgeAll(ctx); err != nil || n != 1 {
+		t.Errorf("PurgeAll = %d, %v, want 1 entry", n, err)
+	}
+	if keys := server.Keys(); len(keys) != 2 {
+		t.Errorf("redis keys after purging = %q, want only the unrelated ones", keys)
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+const (
+	requestIDHeader       = "X-Request-Id"
+	clientRequestIDHeader = "x-ms-client-request-id"
+	// maxClientRequestIDLength is the longest client request ID blob storage
+	// accepts. A longer ID sent by the client is still logged and echoed.
+	maxClientRequestIDLength = 1024
+)
+
+// TagRequests gives every request an ID, reusing the client's X-Request-Id
+// when it sends one, echoes it in the X-Request-Id response header and adds
+// it to the request's logger. Fallbacks and the error page are dispatched
+// with the same context, so every upstream request made for one client
+// request carries its ID.
+func TagRequests() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return middleware.RequestID(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			id := middleware.GetReqID(req.Context())
+			res.Header().Set(requestIDHeader, id)
+			if l, ok := LoggerFromContext(req.Context()).(*slog.Logger); ok {
+				req = req.WithContext(context.WithValue(req.Context(), loggerContextKey{}, l.With("requestId", id)))
+			}
+			next.ServeHTTP(res, req)
+		}))
+	}
+}
+
+// setClientRequestID sends the ID of the client request req was made for to
+// blob storage, which records it in its logs.
+func setClientRequestID(req *http.Request) {
+	if id := middleware.GetReqID(req.Context()); id != "" && len(id) <= maxClientRequestIDLength {
+		req.Header.Set(clientRequestIDHeader, id)
+	}
+}
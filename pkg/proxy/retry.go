@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// maxRetries bounds MaxRetries so a misconfiguration can't turn one client
+// request into a flood of upstream requests during an outage.
+const maxRetries = 5
+
+// retryTransport retries GET and HEAD requests that fail with a connection
+// error or a 5xx, waiting an exponentially growing, fully jittered backoff
+// between attempts. It gives up early rather than sleep past the request's
+// context deadline or the overall timeout.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+}
+
+func newRetryTransport(retries int, backoff time.Duration, timeout time.Duration, next http.RoundTripper) *retryTransport {
+	if retries > maxRetries {
+		retries = maxRetries
+	}
+	if backoff < 0 {
+		backoff = 0
+	}
+	return &retryTransport{next: next, retries: retries, backoff: backoff, timeout: timeout}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	deadline, hasDeadline := req.Context().Deadline()
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.retries || !retryable(resp, err) {
+			return resp, err
+		}
+
+		wait := time.Duration(rand.Int63n(int64(t.backoff<<attempt) + 1))
+		if (t.timeout > 0 && time.Since(start)+wait > t.timeout) || (hasDeadline && time.Now().Add(wait).After(deadline)) {
+			return resp, err
+		}
+
+		logger := LoggerFromContext(req.Context())
+		if err != nil {
+			logger.Warn("upstream request failed, retrying", "url", req.URL.String(), "attempt", attempt+1, "wait", wait, "err", err)
+		} else {
+			logger.Warn("upstream request failed, retrying", "url", req.URL.String(), "attempt", attempt+1, "wait", wait, "status", resp.StatusCode)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
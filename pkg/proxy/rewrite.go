@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// RewriteRule replaces a request path matching the From regex with To, in
+// which $1 or ${name} expand to From's capture groups, e.g. From
+// ^/blog/(.*)$ and To /content/blog/$1.
+type RewriteRule struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+type compiledRewriteRule struct {
+	RewriteRule
+	regex *regexp.Regexp
+}
+
+func compileRewriteRules(rules []RewriteRule) ([]compiledRewriteRule, error) {
+	var compiled []compiledRewriteRule
+	for i, rule := range rules {
+		regex, err := regexp.Compile(rule.From)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: invalid regex %q: %w", i, rule.From, err)
+		}
+		compiled = append(compiled, compiledRewriteRule{RewriteRule: rule, regex: regex})
+	}
+	return compiled, nil
+}
+
+// rewritePath applies the first of rules matching p, and returns p unchanged
+// with a nil rule when none does.
+func rewritePath(rules []compiledRewriteRule, p string) (string, *compiledRewriteRule) {
+	for i, rule := range rules {
+		match := rule.regex.FindStringSubmatchIndex(p)
+		if match != nil {
+			return string(rule.regex.ExpandString(nil, rule.To, p, match)), &rules[i]
+		}
+	}
+	return p, nil
+}
+
+// RewritePaths rewrites the path of requests matching one of rules before
+// they are resolved, so the cache and fallbacks only see the rewritten path.
+// The first matching rule wins, and the query is kept as is.
+func RewritePaths(rules []RewriteRule) (func(next http.Handler) http.Handler, error) {
+	compiled, err := compileRewriteRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if rewritten, rule := rewritePath(compiled, req.URL.Path); rule != nil {
+				LoggerFromContext(req.Context()).Debug("rewriting path", "url", req.URL.String(), "path", rewritten, "rule", rule.From)
+				req = req.Clone(req.Context())
+				req.URL.Path = rewritten
+				req.URL.RawPath = ""
+			}
+			next.ServeHTTP(res, req)
+		})
+	}, nil
+}
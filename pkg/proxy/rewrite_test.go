@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewritePaths(t *testing.T) {
+	rewrite, err := RewritePaths([]RewriteRule{
+		{From: `^/blog/(.*)$`, To: `/content/blog/$1`},
+		{From: `^/u/(?P<user>[^/]+)$`, To: `/users/${user}/profile.html`},
+		{From: `^/blog/`, To: `/never`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rewrite(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.URL.RequestURI()))
+	}))
+
+	for _, tc := range []struct {
+		target string
+		want   string
+	}{
+		{target: "/blog/2024/hello.html", want: "/content/blog/2024/hello.html"},
+		{target: "/blog/post?draft=1", want: "/content/blog/post?draft=1"},
+		{target: "/u/alice", want: "/users/alice/profile.html"},
+		{target: "/about/blog/post", want: "/about/blog/post"},
+		{target: "/u/alice/photos", want: "/u/alice/photos"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if got := rec.Body.String(); got != tc.want {
+			t.Errorf("%s reached the proxy as %s, want %s", tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestRewritePathsInvalidRegex(t *testing.T) {
+	if _, err := RewritePaths([]RewriteRule{{From: "(", To: "/x"}}); err == nil {
+		t.Error("invalid regex was accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+type targetContextKey struct{}
+
+// TargetFromContext returns the container URL selected for the request by
+// RouteContainers, or fallback when no route matched.
+func TargetFromContext(ctx context.Context, fallback *url.URL) *url.URL {
+	if target, ok := ctx.Value(targetContextKey{}).(*url.URL); ok {
+		return target
+	}
+	return fallback
+}
+
+// normalizeRoutePrefix gives prefix a leading slash and no trailing slash, so
+// "app1", "/app1" and "/app1/" all route the same.
+func normalizeRoutePrefix(prefix string) string {
+	return "/" + strings.Trim(strings.TrimSpace(prefix), "/")
+}
+
+// sortedRoutePrefixes returns the prefixes of routes longest first, so the
+// first match is the most specific one.
+func sortedRoutePrefixes(routes map[string]*url.URL) []string {
+	var prefixes []string
+	for prefix := range routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return prefixes
+}
+
+// matchRoutePrefix returns the first of prefixes that path falls under and
+// the path with it stripped, or an empty prefix when none match.
+func matchRoutePrefix(prefixes []string, path string) (string, string) {
+	for _, prefix := range prefixes {
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(path, prefix)
+		if rest == "" {
+			rest = "/"
+		}
+		return prefix, rest
+	}
+	return "", path
+}
+
+// RouteContainers sends requests whose path starts with one of the prefixes in
+// routes to that prefix's container, stripping the prefix from the path. The
+// longest matching prefix wins, and unmatched requests keep the default target.
+func RouteContainers(routes map[string]*url.URL) func(next http.Handler) http.Handler {
+	prefixes := sortedRoutePrefixes(routes)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			prefix, path := matchRoutePrefix(prefixes, req.URL.Path)
+			if prefix == "" {
+				next.ServeHTTP(res, req)
+				return
+			}
+			target := routes[prefix]
+			LoggerFromContext(req.Context()).Debug("routing to container", "prefix", prefix, "target", target.String())
+
+			routed := req.WithContext(context.WithValue(req.Context(), targetContextKey{}, target))
+			routed.URL.RawPath = ""
+			routed.URL.Path = path
+			next.ServeHTTP(res, routed)
+		})
+	}
+}
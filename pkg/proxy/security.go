@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// SecurityHeadersOptions holds the value of each security header to send.
+// A header is left untouched when its value is empty.
+type SecurityHeadersOptions struct {
+	StrictTransportSecurity string
+	ContentTypeOptions      string
+	FrameOptions            string
+	ContentSecurityPolicy   string
+}
+
+func (o SecurityHeadersOptions) headers() map[string]string {
+	headers := map[string]string{}
+	for name, value := range map[string]string{
+		"Strict-Transport-Security": o.StrictTransportSecurity,
+		"X-Content-Type-Options":    o.ContentTypeOptions,
+		"X-Frame-Options":           o.FrameOptions,
+		"Content-Security-Policy":   o.ContentSecurityPolicy,
+	} {
+		if value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+func (o SecurityHeadersOptions) Enabled() bool {
+	return len(o.headers()) > 0
+}
+
+// SecurityHeaders sets the configured headers on every response, replacing
+// any value the upstream sent for the same header.
+func SecurityHeaders(opts SecurityHeadersOptions) func(next http.Handler) http.Handler {
+	headers := opts.headers()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			serveRewritingHeaders(res, req, next, func(status int, header http.Header) {
+				for name, value := range headers {
+					header.Set(name, value)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats holds lock-free counters that are always maintained, so basic numbers
+// are available without enabling Prometheus metrics. Like the Prometheus
+// collectors they are shared by every handler in the process.
+type Stats struct {
+	requests              atomic.Uint64
+	cacheHits             atomic.Uint64
+	cacheMisses           atomic.Uint64
+	fallbackHtml          atomic.Uint64
+	fallbackTrailingSlash atomic.Uint64
+	fallbackIndex         atomic.Uint64
+	fallbackDefaultEnv    atomic.Uint64
+	fallbackSPA           atomic.Uint64
+	upstreamErrors        atomic.Uint64
+}
+
+type StatsSnapshot struct {
+	Requests       uint64            `json:"requests"`
+	CacheHits      uint64            `json:"cacheHits"`
+	CacheMisses    uint64            `json:"cacheMisses"`
+	Fallbacks      map[string]uint64 `json:"fallbacks"`
+	UpstreamErrors uint64            `json:"upstreamErrors"`
+}
+
+var stats Stats
+
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		Requests:    s.requests.Load(),
+		CacheHits:   s.cacheHits.Load(),
+		CacheMisses: s.cacheMisses.Load(),
+		Fallbacks: map[string]uint64{
+			fallbackHtml:          s.fallbackHtml.Load(),
+			fallbackTrailingSlash: s.fallbackTrailingSlash.Load(),
+			fallbackIndex:         s.fallbackIndex.Load(),
+			fallbackDefaultEnv:    s.fallbackDefaultEnv.Load(),
+			fallbackSPA:           s.fallbackSPA.Load(),
+		},
+		UpstreamErrors: s.upstreamErrors.Load(),
+	}
+}
+
+// Stats returns the current request, cache, fallback and upstream error
+// counts.
+func (scp *StorageContainerProxyHandler) Stats() StatsSnapshot {
+	return stats.Snapshot()
+}
+
+func countCacheLookup(result string) {
+	cacheLookupsTotal.WithLabelValues(result).Inc()
+	if result == "hit" {
+		stats.cacheHits.Add(1)
+	} else {
+		stats.cacheMisses.Add(1)
+	}
+}
+
+func countFallback(kind string) {
+	fallbacksTotal.WithLabelValues(kind).Inc()
+	switch kind {
+	case fallbackHtml:
+		stats.fallbackHtml.Add(1)
+	case fallbackTrailingSlash:
+		stats.fallbackTrailingSlash.Add(1)
+	case fallbackIndex:
+		stats.fallbackIndex.Add(1)
+	case fallbackDefaultEnv:
+		stats.fallbackDefaultEnv.Add(1)
+	case fallbackSPA:
+		stats.fallbackSPA.Add(1)
+	}
+}
+
+func CountStats() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			stats.requests.Add(1)
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+func StatsHandler() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		writeJSON(res, req, http.StatusOK, stats.Snapshot())
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func (scp *StorageContainerProxyHandler) tlsEnabled() bool {
+	return scp.AutoTLS || scp.TLSCertFile != ""
+}
+
+// httpsPort is the port RedirectToHTTPS sends clients to: Port when the
+// proxy terminates TLS itself, otherwise the default, since a terminator in
+// front of it decides.
+func (scp *StorageContainerProxyHandler) httpsPort() int {
+	if scp.tlsEnabled() {
+		return scp.Port
+	}
+	return 0
+}
+
+// tlsConfig returns the configuration to serve HTTPS with, and the manager
+// answering ACME challenges when certificates are obtained automatically. A
+// nil config means plain HTTP.
+func (scp *StorageContainerProxyHandler) tlsConfig() (*tls.Config, *autocert.Manager, error) {
+	if scp.AutoTLS {
+		if scp.TLSCertFile != "" || scp.TLSKeyFile != "" {
+			return nil, nil, errors.New("automatic TLS cannot be combined with a certificate file")
+		}
+		if scp.BaseDomain == "" {
+			return nil, nil, errors.New("automatic TLS requires a base domain")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(scp.AutoTLSCacheDir),
+			HostPolicy: scp.autoTLSHostPolicy,
+		}
+		return manager.TLSConfig(), manager, nil
+	}
+
+	if (scp.TLSCertFile == "") != (scp.TLSKeyFile == "") {
+		return nil, nil, errors.New("TLS needs both a certificate and a key file")
+	}
+	if scp.TLSCertFile == "" {
+		return nil, nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(scp.TLSCertFile, scp.TLSKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil, nil
+}
+
+// autoTLSHostPolicy only requests certificates for hosts the proxy serves,
+// the base domain, a single subdomain of it as subdomainPath maps them and
+// the host routes, so arbitrary Host headers can't exhaust the Let's Encrypt
+// rate limits. Any subdomain label is still accepted, since envs aren't
+// known up front.
+func (scp *StorageContainerProxyHandler) autoTLSHostPolicy(_ context.Context, host string) error {
+	host = strings.ToLower(host)
+	if host == strings.ToLower(scp.BaseDomain) {
+		return nil
+	}
+	if scp.UseSubdomains {
+		if _, err := subdomainPath(host, "/", scp.BaseDomain, scp.DefaultEnv); err == nil {
+			return nil
+		}
+	}
+	if _, ok := scp.HostRoutes[host]; ok {
+		return nil
+	}
+	return fmt.Errorf("host %q is not served by this proxy", host)
+}
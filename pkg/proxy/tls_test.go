@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAutoTLSHostPolicy(t *testing.T) {
+	h, err := NewHandler(&Config{
+		AzureStorageAccount:   "account",
+		AzureStorageContainer: "c",
+		BaseDomain:            "Example.com",
+		UseSubdomains:         true,
+		HostRoutes: map[string]Config{
+			"Tenant.example.org": {AzureStorageAccount: "tenant", AzureStorageContainer: "c"},
+		},
+		Logger: discardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host string
+		want bool
+	}{
+		{host: "example.com", want: true},
+		{host: "staging.example.com", want: true},
+		{host: "Staging.Example.com", want: true},
+		{host: "tenant.example.org", want: true},
+		{host: "a.b.example.com", want: false},
+		{host: "evilexample.com", want: false},
+		{host: "example.com.evil.org", want: false},
+		{host: "other.example.org", want: false},
+	} {
+		err := h.autoTLSHostPolicy(context.Background(), tc.host)
+		if (err == nil) != tc.want {
+			t.Errorf("autoTLSHostPolicy(%q) = %v, want allowed %v", tc.host, err, tc.want)
+		}
+	}
+
+	h.UseSubdomains = false
+	if err := h.autoTLSHostPolicy(context.Background(), "staging.example.com"); err == nil {
+		t.Error("subdomain was allowed without UseSubdomains")
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// TrailingSlashPolicy decides which of path and path/ is the canonical URL of
+// an extensionless page.
+type TrailingSlashPolicy string
+
+const (
+	// TrailingSlashNone serves both forms as the fallbacks resolve them.
+	TrailingSlashNone TrailingSlashPolicy = "none"
+	// TrailingSlashAdd redirects path to path/, which the fallbacks resolve
+	// to path/<index> only, so pages need to be stored that way.
+	TrailingSlashAdd TrailingSlashPolicy = "add"
+	// TrailingSlashRemove redirects path/ to path when path/ 404s, so
+	// directories with an index document keep their slash.
+	TrailingSlashRemove TrailingSlashPolicy = "remove"
+)
+
+func ParseTrailingSlashPolicy(s string) (TrailingSlashPolicy, error) {
+	for _, policy := range []TrailingSlashPolicy{TrailingSlashNone, TrailingSlashAdd, TrailingSlashRemove} {
+		if strings.EqualFold(s, string(policy)) {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown trailing slash policy %q", s)
+}
+
+// NormalizeTrailingSlash answers GET and HEAD requests for extensionless
+// paths with a 301 to their canonical form under policy, keeping the query.
+// The root, paths that bypass the fallbacks and paths starting with //,
+// which a browser would read as another host, are served as requested.
+func NormalizeTrailingSlash(policy TrailingSlashPolicy) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			requested := requestedURL(req)
+			p := requested.EscapedPath()
+			slash := strings.HasSuffix(p, "/")
+			if policy == TrailingSlashNone || p == "/" || strings.HasPrefix(p, "//") || (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+				path.Ext(strings.TrimSuffix(p, "/")) != "" || fallbacksBypassed(req) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			switch {
+			case policy == TrailingSlashAdd && !slash:
+				location := trailingSlashLocation(req)
+				LoggerFromContext(req.Context()).Info("adding trailing slash", "url", req.URL.String(), "location", location)
+				http.Redirect(res, req, location, http.StatusMovedPermanently)
+				return
+			case policy == TrailingSlashRemove && slash:
+				// Whether path/ is a directory is only known once it has
+				// been tried, so the redirect waits for its 404.
+				w := newBufferedWriter(res, req)
+				next.ServeHTTP(w, req)
+				if w.StatusCode == http.StatusNotFound && !w.Committed() {
+					location := strings.TrimSuffix(p, "/")
+					if requested.RawQuery != "" {
+						location += "?" + requested.RawQuery
+					}
+					LoggerFromContext(req.Context()).Info("removing trailing slash", "url", req.URL.String(), "location", location)
+					http.Redirect(res, req, location, http.StatusMovedPermanently)
+					return
+				}
+				err := w.WriteTo(res)
+				if err != nil {
+					res.WriteHeader(500)
+					LoggerFromContext(req.Context()).Error("failed to write response", "err", err)
+				}
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+// CanonicalizeIndex answers GET and HEAD requests for a path ending in
+// /<index> with a 301 to the directory, keeping the query, so each page has
+// one URL. It looks at the path the client requested, so the index
+// documents the fallbacks try further down the chain are never redirected.
+func CanonicalizeIndex(index string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			requested := requestedURL(req)
+			p := requested.EscapedPath()
+			dir, ok := strings.CutSuffix(p, "/"+index)
+			if !ok || strings.HasPrefix(p, "//") || (req.Method != http.MethodGet && req.Method != http.MethodHead) || fallbacksBypassed(req) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			location := dir + "/"
+			if requested.RawQuery != "" {
+				location += "?" + requested.RawQuery
+			}
+			LoggerFromContext(req.Context()).Info("redirecting index document to its directory", "url", req.URL.String(), "location", location)
+			http.Redirect(res, req, location, http.StatusMovedPermanently)
+		})
+	}
+}
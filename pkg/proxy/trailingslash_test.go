@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeTrailingSlash(t *testing.T) {
+	container := newFakeContainer(map[string]string{
+		"/c/index.html":      "home",
+		"/c/docs/index.html": "docs",
+		"/c/about.html":      "about",
+		"/c/app.js":          "app",
+	})
+	for _, tc := range []struct {
+		policy   TrailingSlashPolicy
+		target   string
+		code     int
+		location string
+		body     string
+	}{
+		{policy: TrailingSlashAdd, target: "/docs?tab=2", code: http.StatusMovedPermanently, location: "/docs/?tab=2"},
+		{policy: TrailingSlashAdd, target: "/docs/", code: http.StatusOK, body: "docs"},
+		{policy: TrailingSlashAdd, target: "/app.js", code: http.StatusOK, body: "app"},
+		{policy: TrailingSlashAdd, target: "/", code: http.StatusOK, body: "home"},
+
+		{policy: TrailingSlashRemove, target: "/about/?tab=2", code: http.StatusMovedPermanently, location: "/about?tab=2"},
+		{policy: TrailingSlashRemove, target: "/about", code: http.StatusOK, body: "about"},
+		// Directories with an index document keep their slash.
+		{policy: TrailingSlashRemove, target: "/docs/", code: http.StatusOK, body: "docs"},
+		{policy: TrailingSlashRemove, target: "/app.js", code: http.StatusOK, body: "app"},
+		{policy: TrailingSlashRemove, target: "/", code: http.StatusOK, body: "home"},
+
+		{policy: TrailingSlashNone, target: "/docs", code: http.StatusOK, body: "docs"},
+		{policy: TrailingSlashNone, target: "/about/", code: http.StatusNotFound},
+	} {
+		proxy := newTestProxy(t, Config{TrailingSlashPolicy: tc.policy}, container)
+		rec := get(proxy, tc.target)
+		if rec.Code != tc.code || rec.Header().Get("Location") != tc.location || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s %s = %d to %q with %q, want %d to %q with %q",
+				tc.policy, tc.target, rec.Code, rec.Header().Get("Location"), rec.Body.String(), tc.code, tc.location, tc.body)
+		}
+	}
+}
+
+func TestParseTrailingSlashPolicy(t *testing.T) {
+	if policy, err := ParseTrailingSlashPolicy("Remove"); err != nil || policy != TrailingSlashRemove {
+		t.Errorf("ParseTrailingSlashPolicy(Remove) = %q, %v, want remove", policy, err)
+	}
+	if _, err := ParseTrailingSlashPolicy("sometimes"); err == nil {
+		t.Error("unknown policy was accepted")
+	}
+}
+
+func TestCanonicalizeIndex(t *testing.T) {
+	container := newFakeContainer(map[string]string{
+		"/c/index.html":              "home",
+		"/c/about/index.html":        "about",
+		"/c/master/team/index.html":  "team",
+		"/c/docs/default.htm":        "docs",
+		"/c/docs/guide/index.html":   "not an index document here",
+		"/c/master/blog/default.htm": "blog",
+	})
+	for _, tc := range []struct {
+		config   Config
+		target   string
+		code     int
+		location string
+		body     string
+	}{
+		{target: "/about/index.html?tab=2", code: http.StatusMovedPermanently, location: "/about/?tab=2"},
+		{target: "/index.html", code: http.StatusMovedPermanently, location: "/"},
+		// The index documents the fallbacks try are served, not redirected.
+		{target: "/about/", code: http.StatusOK, body: "about"},
+		{target: "/about", code: http.StatusOK, body: "about"},
+		{target: "/", code: http.StatusOK, body: "home"},
+		{config: Config{FallbackEnvs: []string{"master"}}, target: "/team/", code: http.StatusOK, body: "team"},
+		{config: Config{FallbackEnvs: []string{"master"}}, target: "/team/index.html", code: http.StatusMovedPermanently, location: "/team/"},
+
+		{config: Config{IndexDocument: "default.htm"}, target: "/docs/default.htm", code: http.StatusMovedPermanently, location: "/docs/"},
+		{config: Config{IndexDocument: "default.htm"}, target: "/docs/", code: http.StatusOK, body: "docs"},
+		{config: Config{IndexDocument: "default.htm"}, target: "/docs/guide/index.html", code: http.StatusOK, body: "not an index document here"},
+		{config: Config{IndexDocument: "default.htm", FallbackEnvs: []string{"master"}}, target: "/blog", code: http.StatusOK, body: "blog"},
+	} {
+		tc.config.CanonicalizeIndex = true
+		proxy := newTestProxy(t, tc.config, container)
+		rec := get(proxy, tc.target)
+		if rec.Code != tc.code || rec.Header().Get("Location") != tc.location || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s with index %q = %d to %q with %q, want %d to %q with %q", tc.target, tc.config.IndexDocument,
+				rec.Code, rec.Header().Get("Location"), rec.Body.String(), tc.code, tc.location, tc.body)
+		}
+	}
+}
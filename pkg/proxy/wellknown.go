@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FaviconOptions short-circuit /favicon.ico, which browsers request for every
+// site whether it has one or not. At most one may be set.
+type FaviconOptions struct {
+	// File is read once at startup and served as the favicon.
+	File string
+	// RedirectTo sends the client a 302 to this path or URL, e.g. an icon
+	// deployed with the site.
+	RedirectTo string
+	// NoContent answers 204, for sites without a favicon.
+	NoContent bool
+}
+
+func (o FaviconOptions) Enabled() bool {
+	return o.File != "" || o.RedirectTo != "" || o.NoContent
+}
+
+// RobotsTxtHandler serves body as /robots.txt.
+func RobotsTxtHandler(body string) http.HandlerFunc {
+	modified := time.Now()
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(res, req, "robots.txt", modified, bytes.NewReader([]byte(body)))
+	}
+}
+
+// FaviconHandler answers /favicon.ico as options say, reading File up front
+// so a missing file fails at startup rather than on every request.
+func FaviconHandler(options FaviconOptions) (http.HandlerFunc, error) {
+	set := 0
+	for _, ok := range []bool{options.File != "", options.RedirectTo != "", options.NoContent} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("only one of a favicon file, redirect or no content can be set")
+	}
+
+	switch {
+	case options.NoContent:
+		return func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusNoContent)
+		}, nil
+	case options.RedirectTo != "":
+		return func(res http.ResponseWriter, req *http.Request) {
+			http.Redirect(res, req, options.RedirectTo, http.StatusFound)
+		}, nil
+	}
+
+	icon, err := os.ReadFile(options.File)
+	if err != nil {
+		return nil, err
+	}
+	// ServeContent picks the content type from the name, so a PNG icon
+	// is still served as image/png at /favicon.ico.
+	name := filepath.Base(options.File)
+	modified := time.Now()
+	return func(res http.ResponseWriter, req *http.Request) {
+		http.ServeContent(res, req, name, modified, bytes.NewReader(icon))
+	}, nil
+}
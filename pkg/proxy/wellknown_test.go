@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRobotsTxt(t *testing.T) {
+	const robots = "User-agent: *\nDisallow: /private/\n"
+	container := newFakeContainer(map[string]string{"/c/robots.txt": "from the container"})
+	proxy := newTestProxy(t, Config{RobotsTxt: robots}, container)
+
+	rec := get(proxy, "/robots.txt")
+	if rec.Code != http.StatusOK || rec.Body.String() != robots {
+		t.Errorf("/robots.txt = %d %q, want %q", rec.Code, rec.Body.String(), robots)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("/robots.txt Content-Type = %q, want text/plain; charset=utf-8", got)
+	}
+	if hits := container.hits(); len(hits) != 0 {
+		t.Errorf("/robots.txt made upstream requests %v, want none", hits)
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	icon := filepath.Join(t.TempDir(), "icon.png")
+	if err := os.WriteFile(icon, []byte("\x89PNG\r\n\x1a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		options  FaviconOptions
+		code     int
+		location string
+		body     string
+	}{
+		{name: "file", options: FaviconOptions{File: icon}, code: http.StatusOK, body: "\x89PNG\r\n\x1a\n"},
+		{name: "redirect", options: FaviconOptions{RedirectTo: "/static/icon.png"}, code: http.StatusFound, location: "/static/icon.png"},
+		{name: "no content", options: FaviconOptions{NoContent: true}, code: http.StatusNoContent},
+	} {
+		container := newFakeContainer(nil)
+		proxy := newTestProxy(t, Config{Favicon: tc.options}, container)
+		rec := get(proxy, "/favicon.ico")
+		if rec.Code != tc.code || rec.Header().Get("Location") != tc.location || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s: /favicon.ico = %d to %q with %q, want %d to %q with %q",
+				tc.name, rec.Code, rec.Header().Get("Location"), rec.Body.String(), tc.code, tc.location, tc.body)
+		}
+		if hits := container.hits(); len(hits) != 0 {
+			t.Errorf("%s: /favicon.ico made upstream requests %v, want none", tc.name, hits)
+		}
+	}
+}
+
+func TestFaviconHandlerInvalidOptions(t *testing.T) {
+	for _, options := range []FaviconOptions{
+		{NoContent: true, RedirectTo: "/icon.png"},
+		{File: filepath.Join(t.TempDir(), "missing.ico")},
+	} {
+		if _, err := FaviconHandler(options); err == nil {
+			t.Errorf("FaviconHandler(%+v) was accepted", options)
+		}
+	}
+}